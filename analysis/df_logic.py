@@ -16,12 +16,14 @@ def init_geo(geoip_db_path: str):
     geo_reader = maxminddb.open_database(geoip_db_path)
 
 # function to load scan an "unenriched" csv
+# the timestamp is the time the query was sent, rtt-ms is empty if there was no answer
+# source-ip is the local address the query was sent from, empty for the default one
 def load_csv(csv_path, usecols=None) -> pd.DataFrame:
 
     df = pd.read_csv(csv_path,
                      header=None,
                      sep=";",
-                     names=["timestamp", "domain", "ns-ip", "subnet", "returned-subnet", "scope", "returned-ips"],
+                     names=["timestamp", "domain", "ns-ip", "subnet", "returned-subnet", "scope", "returned-ips", "query-id", "rtt-ms", "source-ip"],
                      usecols=usecols,
                      dtype={"timestamp": str,
                             "domain": str,
@@ -29,7 +31,73 @@ def load_csv(csv_path, usecols=None) -> pd.DataFrame:
                             "subnet": str,
                             "returned-subnet": str,
                             "scope": float,
-                            "returned-ips": str})
+                            "returned-ips": str,
+                            "query-id": "Int64",
+                            "rtt-ms": float,
+                            "source-ip": str})
+    return df
+
+# function to load a scan written by the parquet output sink
+# the columns are renamed to match load_csv, returned-ips stays a list instead of a comma joined string
+def load_parquet(parquet_path, usecols=None) -> pd.DataFrame:
+
+    names = {"timestamp": "timestamp",
+             "domain": "domain",
+             "ns_ip": "ns-ip",
+             "subnet": "subnet",
+             "returned_subnet": "returned-subnet",
+             "scope": "scope",
+             "returned_ips": "returned-ips",
+             "query_id": "query-id",
+             "rtt_ms": "rtt-ms",
+             "source_ip": "source-ip"}
+    columns = None
+    if usecols is not None:
+        columns = [k for k, v in names.items() if v in usecols]
+    df = pd.read_parquet(parquet_path, columns=columns)
+    return df.rename(columns=names)
+
+# function to load the stability.csv.gz (or baseline_stability.csv.gz) of a scan with repeat_queries > 1
+# one row per (domain, ns-ip, subnet); stability is the share of the answered repeats that returned
+# the most frequent answer set, answer-sets lists every set with its count as "ip1,ip2=count|ip3=count"
+def load_stability_csv(csv_path, usecols=None) -> pd.DataFrame:
+
+    df = pd.read_csv(csv_path,
+                     header=None,
+                     sep=";",
+                     names=["domain", "ns-ip", "subnet", "queries", "answered", "distinct-answer-sets", "stability", "answer-sets"],
+                     usecols=usecols,
+                     dtype={"domain": str,
+                            "ns-ip": str,
+                            "subnet": str,
+                            "queries": int,
+                            "answered": int,
+                            "distinct-answer-sets": int,
+                            "stability": float,
+                            "answer-sets": str})
+    return df
+
+# puts the answers of the baseline queries (baseline.csv.gz, loaded with load_csv or load_parquet)
+# next to the ecs answers of the scan: baseline-ips are the answers without ecs (empty subnet),
+# zero-ips the ones with ecs 0.0.0.0/0; differs-from-baseline is true if the ecs answer is
+# not the same set of ips as the one without ecs
+def add_baseline(df: pd.DataFrame, baseline_df: pd.DataFrame) -> pd.DataFrame:
+
+    def ip_set(ips):
+        if type(ips) is float:
+            return frozenset()
+        if type(ips) is str:
+            return frozenset(str.split(ips, ","))
+        return frozenset(ips)
+
+    keys = ["domain", "ns-ip"]
+    no_ecs = baseline_df[baseline_df["subnet"].isna() | (baseline_df["subnet"] == "")]
+    zero = baseline_df[baseline_df["subnet"] == "0.0.0.0/0"]
+    no_ecs = no_ecs[keys + ["returned-ips"]].drop_duplicates(keys).rename(columns={"returned-ips": "baseline-ips"})
+    zero = zero[keys + ["returned-ips"]].drop_duplicates(keys).rename(columns={"returned-ips": "zero-ips"})
+    df = df.merge(no_ecs, on=keys, how="left").merge(zero, on=keys, how="left")
+    df["differs-from-baseline"] = [ip_set(ips) != ip_set(baseline)
+                                   for ips, baseline in zip(df["returned-ips"], df["baseline-ips"])]
     return df
 
 # function to load a scan csv enriched with geolocation data
@@ -133,7 +201,7 @@ def create_enriched_data(csv_path: str, enr_path: str, truncate=False):
                      chunksize=chunk_size,
                      header=None,
                      sep=";",
-                     names=["timestamp", "domain", "ns-ip", "subnet", "returned-subnet", "scope", "returned-ips"],
+                     names=["timestamp", "domain", "ns-ip", "subnet", "returned-subnet", "scope", "returned-ips", "query-id", "rtt-ms", "source-ip"],
                      usecols=["timestamp", "domain", "ns-ip", "subnet", "returned-subnet", "scope", "returned-ips"],
                      dtype={"timestamp": str,
                             "domain": str,
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"ecs/ecs"
+
+	"github.com/miekg/dns"
+)
+
+// raw message capture
+// with capture enabled, every query sent by the resolver, the prober and probe_query and
+// every response they receive is written to a pcapng file as synthesized IP/UDP packets of
+// the wire messages. each packet carries a comment "qid=<query id>", the same id is
+// written into the scan rows, so that rows can be matched with the exact bytes later on
+
+// query ids are unique per run, the dns message id is too short for that
+var last_query_id atomic.Uint64
+
+func next_query_id() uint64 {
+	return last_query_id.Add(1)
+}
+
+type capture_packet struct {
+	qid    uint64
+	ts     time.Time
+	src    *net.UDPAddr
+	dst    *net.UDPAddr
+	wire   []byte
+	source string // which part of the scanner sent it
+}
+
+var capture_chan = make(chan *capture_packet, 4096)
+
+// sends msg to server with transport and returns the answer
+// the query is given up after query_timeout_ms or when ctx is done
+// if capture is enabled the raw messages are recorded with the given query id
+func exchange(ctx context.Context, transport ecs.Transport, msg *dns.Msg, server string, qid uint64, source string) (*dns.Msg, time.Duration, error) {
+	stat_queries.Add(1)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Query_timeout_ms)*time.Millisecond)
+	defer cancel()
+	var rec *dns.Msg
+	var rtt time.Duration
+	var err error
+	if !cfg.Capture {
+		rec, rtt, err = transport.Exchange(ctx, msg, server, qid)
+	} else if udp, ok := transport.(*ecs.Udp_transport); ok {
+		rec, rtt, err = exchange_raw(ctx, udp, msg, server, qid, source)
+	} else {
+		rec, rtt, err = exchange_recorded(ctx, transport, msg, server, qid, source)
+	}
+	observe_exchange(source, rec, err)
+	if err != nil {
+		stat_errors.Add(1)
+	}
+	return rec, rtt, err
+}
+
+// the other transports are recorded as if the messages had been sent over udp, from
+// the source address if one is set and the unspecified one otherwise
+// the answer is packed again and may differ from the bytes received in its name
+// compression
+func exchange_recorded(ctx context.Context, transport ecs.Transport, msg *dns.Msg, server string, qid uint64, source string) (*dns.Msg, time.Duration, error) {
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	remote, _ := net.ResolveUDPAddr("udp", server)
+	local := &net.UDPAddr{IP: ecs.Source(ctx)}
+	if local.IP == nil && remote != nil && remote.IP.To4() == nil {
+		local.IP = net.IPv6unspecified
+	} else if local.IP == nil {
+		local.IP = net.IPv4zero
+	}
+	t := time.Now()
+	capture_chan <- &capture_packet{qid: qid, ts: t, src: local, dst: remote, wire: query, source: source}
+	rec, rtt, err := transport.Exchange(ctx, msg, server, qid)
+	if rec != nil {
+		if resp, err := rec.Pack(); err == nil {
+			capture_chan <- &capture_packet{qid: qid, ts: t.Add(rtt), src: remote, dst: local, wire: resp, source: source}
+		}
+	}
+	return rec, rtt, err
+}
+
+func exchange_raw(ctx context.Context, transport *ecs.Udp_transport, msg *dns.Msg, server string, qid uint64, source string) (*dns.Msg, time.Duration, error) {
+	conn, err := transport.Dial(ctx, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	remote, _ := conn.RemoteAddr().(*net.UDPAddr)
+
+	t := time.Now()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	capture_chan <- &capture_packet{qid: qid, ts: t, src: local, dst: remote, wire: query, source: source}
+	for {
+		resp, err := conn.ReadMsgHeader(nil)
+		rtt := time.Since(t)
+		if err != nil {
+			return nil, rtt, err
+		}
+		capture_chan <- &capture_packet{qid: qid, ts: t.Add(rtt), src: remote, dst: local, wire: resp, source: source}
+		rec := new(dns.Msg)
+		if err := rec.Unpack(resp); err != nil {
+			return rec, rtt, err
+		}
+		// ignore replies with mismatched ids, they might belong to earlier queries that timed out
+		if rec.Id == msg.Id {
+			return rec, rtt, nil
+		}
+	}
+}
+
+// internet checksum over the given bytes
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// wraps the dns message into an ip and udp header
+func synthesize_packet(pkt *capture_packet) []byte {
+	udp := make([]byte, 8+len(pkt.wire))
+	binary.BigEndian.PutUint16(udp[0:], uint16(pkt.src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(pkt.dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], pkt.wire)
+
+	if src4, dst4 := pkt.src.IP.To4(), pkt.dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45 // version 4, 5 words header
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64 // ttl
+		ip[9] = 17 // udp
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		// the udp checksum is optional for ipv4
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40)
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17 // udp
+	ip[7] = 64 // hop limit
+	copy(ip[8:], pkt.src.IP.To16())
+	copy(ip[24:], pkt.dst.IP.To16())
+	// pseudo header: addresses, length and next header
+	pseudo := uint32(len(udp)) + 17
+	for i := 8; i < 40; i += 2 {
+		pseudo += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	binary.BigEndian.PutUint16(udp[6:], checksum(udp, pseudo))
+	return append(ip, udp...)
+}
+
+// pcapng blocks, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+func pcapng_block(block_type uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:], block_type)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	return binary.LittleEndian.AppendUint32(block, length)
+}
+
+func pcapng_option(code uint16, value []byte) []byte {
+	opt := binary.LittleEndian.AppendUint16(nil, code)
+	opt = binary.LittleEndian.AppendUint16(opt, uint16(len(value)))
+	opt = append(opt, value...)
+	for len(opt)%4 != 0 {
+		opt = append(opt, 0)
+	}
+	return opt
+}
+
+func pcapng_header() []byte {
+	// section header: byte order magic, version 1.0, unknown section length
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shb = append(shb, pcapng_option(4, []byte("ecs scanner"))...) // shb_userappl
+	shb = append(shb, 0, 0, 0, 0)                                 // opt_endofopt
+	// interface description: raw ip, no snap length, microsecond timestamps (default)
+	idb := binary.LittleEndian.AppendUint16(nil, 101)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	return append(pcapng_block(0x0A0D0D0A, shb), pcapng_block(1, idb)...)
+}
+
+func pcapng_packet(pkt *capture_packet) []byte {
+	data := synthesize_packet(pkt)
+	ts := uint64(pkt.ts.UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface id
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	for len(epb)%4 != 0 {
+		epb = append(epb, 0)
+	}
+	comment := "qid=" + strconv.FormatUint(pkt.qid, 10) + " source=" + pkt.source
+	epb = append(epb, pcapng_option(1, []byte(comment))...) // opt_comment
+	epb = append(epb, 0, 0, 0, 0)                           // opt_endofopt
+	return pcapng_block(6, epb)
+}
+
+func writeout_capture(ctx context.Context) {
+	if err := os.MkdirAll(cfg.Output_dir, 0755); err != nil {
+		panic(err)
+	}
+	pcapfile, err := os.Create(output_path("capture", ".pcapng"))
+	if err != nil {
+		panic(err)
+	}
+	defer pcapfile.Close()
+
+	writer := bufio.NewWriter(pcapfile)
+	defer writer.Flush()
+	writer.Write(pcapng_header())
+
+	write := func(pkt *capture_packet) {
+		if pkt.src == nil || pkt.dst == nil {
+			return
+		}
+		log_trace(log_writer, "capturing packet", "qid", pkt.qid, "src", pkt.src, "dst", pkt.dst)
+		writer.Write(pcapng_packet(pkt))
+	}
+	for {
+		select {
+		case pkt := <-capture_chan:
+			write(pkt)
+		case <-ctx.Done():
+			// write what is still waiting in the channel
+			for {
+				select {
+				case pkt := <-capture_chan:
+					write(pkt)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"ecs/ecs"
+
+	"github.com/miekg/dns"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data    string
+		initial uint32
+		want    uint16
+	}{
+		// the example of rfc 1071, section 3
+		{"0001f203f4f5f6f7", 0, 0x220d},
+		// odd length, the last byte is padded with zero
+		{"0001f203f4f5f6f7ff", 0, 0x230c},
+		{"", 0, 0xffff},
+		// the ipv4 header from the wikipedia article on the checksum, with its checksum zeroed
+		{"450000730000400040110000c0a80001c0a800c7", 0, 0xb861},
+		{"", 0x1fffe, 0x0000},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		if got := checksum(data, test.initial); got != test.want {
+			t.Errorf("checksum(%s, %#x) = %#04x, want %#04x", test.data, test.initial, got, test.want)
+		}
+	}
+}
+
+// the one's complement sum, computed independently of checksum, is 0xffff over data
+// with a valid checksum
+func ones_sum(chunks ...[]byte) uint16 {
+	data := bytes.Join(chunks, nil)
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+	var sum uint16
+	for i := 0; i < len(data); i += 2 {
+		word := binary.BigEndian.Uint16(data[i:])
+		sum += word
+		if sum < word {
+			sum++ // end around carry
+		}
+	}
+	return sum
+}
+
+// decodes the ip and udp header of a synthesized packet and checks its lengths and
+// checksums, returns the addresses and the payload
+func decode_packet(t *testing.T, packet []byte) (src *net.UDPAddr, dst *net.UDPAddr, payload []byte) {
+	t.Helper()
+	var udp []byte
+	var pseudo []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 28 || packet[0]&0x0f != 5 || packet[9] != 17 {
+			t.Fatalf("not an ipv4 udp packet: %x", packet)
+		}
+		if int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+			t.Errorf("ipv4 total length %d of %d bytes", binary.BigEndian.Uint16(packet[2:]), len(packet))
+		}
+		if ones_sum(packet[:20]) != 0xffff {
+			t.Errorf("bad ipv4 header checksum %x", packet[:20])
+		}
+		src = &net.UDPAddr{IP: net.IP(packet[12:16])}
+		dst = &net.UDPAddr{IP: net.IP(packet[16:20])}
+		udp = packet[20:]
+	case 6:
+		if len(packet) < 48 || packet[6] != 17 {
+			t.Fatalf("not an ipv6 udp packet: %x", packet)
+		}
+		if int(binary.BigEndian.Uint16(packet[4:])) != len(packet)-40 {
+			t.Errorf("ipv6 payload length %d of %d bytes", binary.BigEndian.Uint16(packet[4:]), len(packet)-40)
+		}
+		src = &net.UDPAddr{IP: net.IP(packet[8:24])}
+		dst = &net.UDPAddr{IP: net.IP(packet[24:40])}
+		udp = packet[40:]
+		pseudo = append(append([]byte{}, packet[8:40]...), 0, 0, 0, 0, 0, 0, 0, 17)
+		binary.BigEndian.PutUint16(pseudo[34:], uint16(len(udp)))
+	default:
+		t.Fatalf("ip version %d", packet[0]>>4)
+	}
+	if int(binary.BigEndian.Uint16(udp[4:])) != len(udp) {
+		t.Errorf("udp length %d of %d bytes", binary.BigEndian.Uint16(udp[4:]), len(udp))
+	}
+	// optional with ipv4, zero if unset
+	if pseudo != nil || binary.BigEndian.Uint16(udp[6:]) != 0 {
+		if ones_sum(pseudo, udp) != 0xffff {
+			t.Errorf("bad udp checksum %x", udp[6:8])
+		}
+	}
+	src.Port = int(binary.BigEndian.Uint16(udp[0:]))
+	dst.Port = int(binary.BigEndian.Uint16(udp[2:]))
+	return src, dst, udp[8:]
+}
+
+func TestSynthesizePacket(t *testing.T) {
+	wire := []byte{0x12, 0x34, 0x01, 0x00, 0x00}
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string // the packet as computed by hand
+	}{
+		{"v4", "192.0.2.1:5353", "198.51.100.53:53",
+			"450000210000000040118e62" + "c0000201c6336435" + // ip header
+				"14e90035000d0000" + "1234010000"}, // udp header, payload
+		{"v6", "[2001:db8::1]:5353", "[2001:db8::53]:53",
+			"60000000000d1140" + "20010db8000000000000000000000001" + "20010db8000000000000000000000053" +
+				"14e90035000d7bbc" + "1234010000"},
+		// the addresses of a v4 socket are often v4 in v6
+		{"v4 in v6", "[::ffff:192.0.2.1]:5353", "198.51.100.53:53",
+			"450000210000000040118e62" + "c0000201c6336435" + "14e90035000d0000" + "1234010000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, _ := net.ResolveUDPAddr("udp", test.src)
+			dst, _ := net.ResolveUDPAddr("udp", test.dst)
+			packet := synthesize_packet(&capture_packet{src: src, dst: dst, wire: wire})
+			if got := hex.EncodeToString(packet); got != test.want {
+				t.Errorf("packet\n got %s\nwant %s", got, test.want)
+			}
+			got_src, got_dst, payload := decode_packet(t, packet)
+			if !got_src.IP.Equal(src.IP) || got_src.Port != src.Port || !got_dst.IP.Equal(dst.IP) || got_dst.Port != dst.Port {
+				t.Errorf("%s -> %s, want %s -> %s", got_src, got_dst, src, dst)
+			}
+			if !bytes.Equal(payload, wire) {
+				t.Errorf("payload %x, want %x", payload, wire)
+			}
+		})
+	}
+}
+
+// queries over tcp and the other stream transports are recorded as udp packets, from
+// the unspecified address of the family of the server
+func TestExchangeRecorded(t *testing.T) {
+	cfg.Query_timeout_ms = 2000
+	transport := ecs.Exchange_func(func(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+		rec := new(dns.Msg)
+		rec.SetReply(msg)
+		rec.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("198.51.100.10"),
+		}}
+		return rec, 3 * time.Millisecond, nil
+	})
+	for _, server := range []string{"192.0.2.53:53", "[2001:db8::53]:853"} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.com.", dns.TypeA)
+		if _, _, err := exchange_recorded(context.Background(), transport, msg, server, 42, "test"); err != nil {
+			t.Fatal(err)
+		}
+		remote, _ := net.ResolveUDPAddr("udp", server)
+		for i, want_query := range []bool{true, false} {
+			pkt := <-capture_chan
+			if pkt.qid != 42 || pkt.source != "test" {
+				t.Errorf("packet %d of %s: qid %d, source %q", i, server, pkt.qid, pkt.source)
+			}
+			src, dst, payload := decode_packet(t, synthesize_packet(pkt))
+			local, peer := src, dst
+			if !want_query {
+				local, peer = dst, src
+			}
+			if !peer.IP.Equal(remote.IP) || peer.Port != remote.Port || !local.IP.IsUnspecified() {
+				t.Errorf("packet %d of %s: %s -> %s", i, server, src, dst)
+			}
+			if (local.IP.To4() == nil) != (remote.IP.To4() == nil) {
+				t.Errorf("packet %d of %s: local address %s of another family", i, server, local.IP)
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(payload); err != nil {
+				t.Fatalf("packet %d of %s: %v", i, server, err)
+			}
+			if m.Response == want_query || m.Question[0].Name != "www.example.com." {
+				t.Errorf("packet %d of %s: %s", i, server, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// command line interface
+// every phase of the scan can be run on its own:
+//
+//	ecs [subcommand] [flags] [args]
+//
+// all subcommands accept -config and one flag per cfg_db field (named after its
+// yaml key) which overrides the value from the config file
+
+type subcommand struct {
+	name     string
+	args     string
+	usage    string
+	run      func(args []string) error
+	required []string // config keys validate_config insists on
+}
+
+var subcommands []*subcommand
+
+func init() {
+	subcommands = []*subcommand{
+		{"full", "", "resolve the nameservers and scan them with all subnets (default)", cmd_full,
+			[]string{"toplist_fname", "subnets_fname"}},
+		{"resolve-ns", "", "only resolve the nameservers and write them to nameserver_fname", cmd_resolve_ns,
+			[]string{"toplist_fname", "nameserver_fname"}},
+		{"scan-ecs", "", "only scan the nameservers read from nameserver_fname", cmd_scan_ecs,
+			[]string{"nameserver_fname", "subnets_fname"}},
+		{"repeat", "", "repeat the scan every round_interval seconds, each round in its own directory", cmd_repeat,
+			[]string{"toplist_fname", "subnets_fname"}},
+		{"diff", "<old.csv.gz> <new.csv.gz>", "compare the ecs support, scopes and answers of two scan files", cmd_diff,
+			[]string{}},
+		{"report", "<scan.csv.gz>...", "classify the ecs support of every nameserver and domain of scan files", cmd_report,
+			[]string{}},
+		{"enrich", "<scan.csv.gz> <out.csv.gz>", "annotate a scan file with country, continent and asn from mmdb_paths", cmd_enrich,
+			[]string{"mmdb_paths"}},
+		{"gen-subnets", "<subnets.txt>", "build a subnet list with one prefix per country and origin as from rib_fname", cmd_gen_subnets,
+			[]string{"rib_fname", "mmdb_paths"}},
+		{"probe", "<domain> <subnet>...", "resolve a single domain and compare the ecs answers of its nameserver", cmd_probe,
+			[]string{}},
+		{"probe-resolvers", "", "probe the recursive resolvers in resolvers_fname for ecs forwarding", cmd_probe_resolvers,
+			[]string{"resolvers_fname", "subnets_fname", "probe_zone"}},
+		{"echo-server", "", "run the ecs echo authoritative for echo_zone", cmd_echo_server,
+			[]string{"echo_zone", "echo_listen"}},
+		{"verify-config", "", "validate the config for a subcommand and print the effective values", cmd_verify_config,
+			[]string{}},
+	}
+}
+
+// flag.Value collecting the overrides of a single cfg_db field
+type cfg_override struct {
+	key      string
+	value    *string
+	is_bool  bool
+	assigned bool
+}
+
+func (o *cfg_override) String() string {
+	if o == nil || o.value == nil {
+		return ""
+	}
+	return *o.value
+}
+
+func (o *cfg_override) Set(s string) error {
+	*o.value = s
+	o.assigned = true
+	return nil
+}
+
+func (o *cfg_override) IsBoolFlag() bool {
+	return o.is_bool
+}
+
+// yaml key of every cfg_db field, in declaration order
+func cfg_keys() []string {
+	cfg_type := reflect.TypeOf(cfg)
+	keys := make([]string, 0, cfg_type.NumField())
+	for i := 0; i < cfg_type.NumField(); i++ {
+		keys = append(keys, strings.Split(cfg_type.Field(i).Tag.Get("yaml"), ",")[0])
+	}
+	return keys
+}
+
+func cfg_field(key string) (reflect.Value, bool) {
+	cfg_type := reflect.TypeOf(cfg)
+	for i := 0; i < cfg_type.NumField(); i++ {
+		if strings.Split(cfg_type.Field(i).Tag.Get("yaml"), ",")[0] == key {
+			return reflect.ValueOf(&cfg).Elem().Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func set_cfg_field(key string, value string) error {
+	field, ok := cfg_field(key)
+	if !ok {
+		return fmt.Errorf("unknown config key %s", key)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s: unsupported type %s", key, field.Type())
+		}
+		field.Set(reflect.ValueOf(strings.Split(value, ",")))
+	default:
+		return fmt.Errorf("%s: unsupported type %s", key, field.Kind())
+	}
+	return nil
+}
+
+func get_subcommand(name string) *subcommand {
+	for _, cmd := range subcommands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// registers -config and the cfg_db overrides on the flag set
+// the returned function loads the config, applies the overrides and validates
+// the result against the requirements of the subcommand (or the one given by -for)
+func cfg_flags(fs *flag.FlagSet) func() error {
+	config_path := fs.String("config", "config.yml", "path to the config file")
+	overrides := make([]*cfg_override, 0)
+	for _, key := range cfg_keys() {
+		field, _ := cfg_field(key)
+		o := &cfg_override{key: key, value: new(string), is_bool: field.Kind() == reflect.Bool}
+		overrides = append(overrides, o)
+		fs.Var(o, key, "override "+key+" from the config file")
+	}
+	return func() error {
+		if err := load_config(*config_path); err != nil {
+			return err
+		}
+		for _, o := range overrides {
+			if !o.assigned {
+				continue
+			}
+			if err := set_cfg_field(o.key, *o.value); err != nil {
+				return err
+			}
+		}
+		// the levels are checked by validate_config below
+		setup_logging()
+		log_main.Info("config loaded", "path", *config_path)
+		for _, o := range overrides {
+			if o.assigned {
+				log_main.Info("config override", "key", o.key, "value", *o.value)
+			}
+		}
+		name := fs.Name()
+		if for_flag := fs.Lookup("for"); for_flag != nil {
+			name = for_flag.Value.String()
+		}
+		cmd := get_subcommand(name)
+		if cmd == nil {
+			return fmt.Errorf("unknown subcommand %s", name)
+		}
+		if err := validate_config(cmd.required...); err != nil {
+			return err
+		}
+		limit_run()
+		return nil
+	}
+}
+
+func print_usage() {
+	fmt.Fprintln(os.Stderr, "usage: ecs [subcommand] [flags] [args]")
+	fmt.Fprintln(os.Stderr, "subcommands:")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", cmd.name+" "+cmd.args, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr, "run 'ecs <subcommand> -h' to list the flags")
+}
+
+func run_cli(args []string) int {
+	name := "full"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	if name == "help" {
+		print_usage()
+		return 0
+	}
+	cmd := get_subcommand(name)
+	if cmd == nil {
+		fmt.Fprintln(os.Stderr, "unknown subcommand:", name)
+		print_usage()
+		return 2
+	}
+	run_command = name
+	handle_signals()
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if interrupted() {
+		return 130
+	}
+	return 0
+}
+
+func new_flag_set(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ecs", name, "[flags]", args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func cmd_full(args []string) error {
+	fs := new_flag_set("full", "")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	exclude_ips()
+	if err := setup_scanner(); err != nil {
+		return err
+	}
+	start_writer(writeout)
+	start_capture()
+	start_metrics()
+	start_profiling()
+	run_ns_phase()
+	run_ecs_phase()
+	stop_writers()
+	return nil
+}
+
+func cmd_repeat(args []string) error {
+	fs := new_flag_set("repeat", "")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	exclude_ips()
+	if err := setup_scanner(); err != nil {
+		return err
+	}
+	run_rounds()
+	return nil
+}
+
+func cmd_resolve_ns(args []string) error {
+	fs := new_flag_set("resolve-ns", "")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	// the nameservers are the only result of this phase
+	cfg.Nameserver_writeout = true
+	exclude_ips()
+	if err := setup_scanner(); err != nil {
+		return err
+	}
+	start_writer(writeout)
+	start_capture()
+	start_metrics()
+	start_profiling()
+	run_ns_phase()
+	stop_writers()
+	return nil
+}
+
+func cmd_scan_ecs(args []string) error {
+	fs := new_flag_set("scan-ecs", "")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	exclude_ips()
+	if err := setup_scanner(); err != nil {
+		return err
+	}
+	read_nameservers()
+	start_writer(writeout)
+	start_capture()
+	start_metrics()
+	start_profiling()
+	run_ecs_phase()
+	stop_writers()
+	return nil
+}
+
+func cmd_probe_resolvers(args []string) error {
+	fs := new_flag_set("probe-resolvers", "")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	exclude_ips()
+	if err := setup_transport(); err != nil {
+		return err
+	}
+	start_capture()
+	start_metrics()
+	start_profiling()
+	probe_resolvers()
+	stop_writers()
+	return nil
+}
+
+func cmd_echo_server(args []string) error {
+	fs := new_flag_set("echo-server", "")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	return serve_echo()
+}
+
+func cmd_verify_config(args []string) error {
+	fs := new_flag_set("verify-config", "")
+	load := cfg_flags(fs)
+	for_cmd := fs.String("for", "full", "validate the config for this subcommand")
+	env := fs.Bool("env", false, "list the environment variables that override the config")
+	fs.Parse(args)
+	if *env {
+		print_config_env()
+		return nil
+	}
+	err := load()
+	for _, key := range cfg_keys() {
+		field, _ := cfg_field(key)
+		fmt.Printf("%s: %v\n", key, field.Interface())
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("config is valid for", *for_cmd)
+	return nil
+}
+
+func main() {
+	os.Exit(run_cli(os.Args[1:]))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"ecs/ecs"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// config
+// every key can also be set with the environment variable in its env tag, which takes
+// precedence over the config file; keys that are missing in both get their env-default
+// verbosity
+// 0: off | 1-3: info, warnings and errors | 4: debug, spam the console | 5: trace, equivalent of setting discord to light mode
+type cfg_db struct {
+	Verbosity              int      `yaml:"verbosity" env:"ECS_VERBOSITY" env-default:"0" env-description:"log verbosity from 0 (off) to 5"`
+	Log_levels             []string `yaml:"log_levels" env:"ECS_LOG_LEVELS" env-separator:"," env-description:"per subsystem log levels overriding verbosity, e.g. resolver=debug,writer=off"`
+	Log_format             string   `yaml:"log_format" env:"ECS_LOG_FORMAT" env-default:"text" env-description:"log output format, text or json"`
+	Nameserver_writeout    bool     `yaml:"nameserver_writeout" env:"ECS_NAMESERVER_WRITEOUT" env-description:"write the resolved domain-ns pairs to nameserver_fname"`
+	Toplist_fname          string   `yaml:"toplist_fname" env:"ECS_TOPLIST_FNAME" env-default:"top-1m.csv" env-description:"toplist csv (rank,domain) to resolve"`
+	Subnets_fname          string   `yaml:"subnets_fname" env:"ECS_SUBNETS_FNAME" env-default:"subnets.txt" env-description:"list of subnets in CIDR notation to scan with"`
+	Number_of_domains      int      `yaml:"no_of_domains" env:"ECS_NO_OF_DOMAINS" env-default:"-1" env-description:"number of toplist entries to read, -1 for all"`
+	Simul_ecs_reqs         int      `yaml:"simul_ecs_reqs" env:"ECS_SIMUL_ECS_REQS" env-default:"100" env-description:"number of concurrent ecs query routines"`
+	Simul_ns_reqs          int      `yaml:"simul_ns_reqs" env:"ECS_SIMUL_NS_REQS" env-default:"50" env-description:"number of concurrent nameserver resolving routines"`
+	Query_timeout_ms       int      `yaml:"query_timeout_ms" env:"ECS_QUERY_TIMEOUT_MS" env-default:"5000" env-description:"milliseconds to wait for the answer to a single query"`
+	Transport              string   `yaml:"transport" env:"ECS_TRANSPORT" env-default:"udp" env-description:"transport of the ecs and resolver probe queries, udp, tcp, tls or https; the resolution always uses udp"`
+	Transport_port         int      `yaml:"transport_port" env:"ECS_TRANSPORT_PORT" env-default:"0" env-description:"port of the ecs and resolver probe queries, 0 for the default (53, 853 for tls, 443 for https)"`
+	Tls_server_name        string   `yaml:"tls_server_name" env:"ECS_TLS_SERVER_NAME" env-description:"name the certificates of tls and https servers are verified against, empty for their ip"`
+	Tls_insecure           bool     `yaml:"tls_insecure" env:"ECS_TLS_INSECURE" env-description:"skip the certificate verification of tls and https servers"`
+	Source_addrs           []string `yaml:"source_addrs" env:"ECS_SOURCE_ADDRS" env-separator:"," env-description:"local ipv4/ipv6 addresses the queries are sent from in turn, empty for the default"`
+	Source_interface       string   `yaml:"source_interface" env:"ECS_SOURCE_INTERFACE" env-description:"network interface whose addresses are added to source_addrs"`
+	Resolve_timeout        int      `yaml:"resolve_timeout" env:"ECS_RESOLVE_TIMEOUT" env-default:"0" env-description:"seconds the resolution of a single domain may take, 0 for no limit"`
+	Phase_timeout          int      `yaml:"phase_timeout" env:"ECS_PHASE_TIMEOUT" env-default:"0" env-description:"seconds a single phase may take, 0 for no limit"`
+	Run_timeout            int      `yaml:"run_timeout" env:"ECS_RUN_TIMEOUT" env-default:"0" env-description:"seconds the whole run may take before it is stopped gracefully, 0 for no limit"`
+	Schedule               string   `yaml:"schedule" env:"ECS_SCHEDULE" env-default:"subnet" env-description:"order of the ecs queries: subnet (one subnet after the other), domain (all subnets of a domain back to back) or random"`
+	Baseline_queries       bool     `yaml:"baseline_queries" env:"ECS_BASELINE_QUERIES" env-default:"false" env-description:"query every nameserver once without ecs and once with 0.0.0.0/0 before the scan, written to the baseline files"`
+	Repeat_queries         int      `yaml:"repeat_queries" env:"ECS_REPEAT_QUERIES" env-default:"1" env-description:"times every ecs and baseline query is sent, above 1 their answers are summarized in the stability files"`
+	Repeat_spacing_ms      int      `yaml:"repeat_spacing_ms" env:"ECS_REPEAT_SPACING_MS" env-default:"1000" env-description:"milliseconds between the repeats of a query"`
+	Rounds                 int      `yaml:"rounds" env:"ECS_ROUNDS" env-default:"0" env-description:"number of scans the repeat subcommand runs, 0 until it is stopped"`
+	Round_interval         int      `yaml:"round_interval" env:"ECS_ROUND_INTERVAL" env-default:"604800" env-description:"seconds from the start of one round of repeat to the start of the next"`
+	Resolve_every          int      `yaml:"resolve_every" env:"ECS_RESOLVE_EVERY" env-default:"1" env-description:"repeat resolves the nameservers again every that many rounds"`
+	Intermediate_depth     int      `yaml:"intermediate_depth" env:"ECS_INTERMEDIATE_DEPTH" env-description:"number of single character nodes per label in the cache tree"`
+	Blocklist_path         string   `yaml:"blocklist_path" env:"ECS_BLOCKLIST_PATH" env-description:"list of networks that must not be queried, skipped if missing"`
+	Nameserver_fname       string   `yaml:"nameserver_fname" env:"ECS_NAMESERVER_FNAME" env-default:"nameserver.csv.gz" env-description:"domain-ns pairs written by resolve-ns and read by scan-ecs"`
+	Resolvers_fname        string   `yaml:"resolvers_fname" env:"ECS_RESOLVERS_FNAME" env-default:"resolvers.txt" env-description:"list of recursive resolvers (ip or ip:port) to probe"`
+	Probe_zone             string   `yaml:"probe_zone" env:"ECS_PROBE_ZONE" env-description:"zone served by the echo authoritative that resolvers are probed with"`
+	Echo_zone              string   `yaml:"echo_zone" env:"ECS_ECHO_ZONE" env-description:"zone the echo server is authoritative for"`
+	Echo_listen            string   `yaml:"echo_listen" env:"ECS_ECHO_LISTEN" env-default:":53" env-description:"address the echo server listens on"`
+	Output_sinks           []string `yaml:"output_sinks" env:"ECS_OUTPUT_SINKS" env-default:"csv" env-separator:"," env-description:"where the results go, any of csv, jsonl, parquet and stdout"`
+	Output_dir             string   `yaml:"output_dir" env:"ECS_OUTPUT_DIR" env-default:"." env-description:"directory all output files are written to"`
+	Output_name            string   `yaml:"output_name" env:"ECS_OUTPUT_NAME" env-default:"{kind}" env-description:"output file name without extension, {run}, {time} and {kind} are replaced"`
+	Run_id                 string   `yaml:"run_id" env:"ECS_RUN_ID" env-description:"identifier of this run for the output file names"`
+	Mmdb_paths             []string `yaml:"mmdb_paths" env:"ECS_MMDB_PATHS" env-separator:"," env-description:"mmdb databases (ipinfo or maxmind format) enrich and gen-subnets look up country, continent and asn in, the first one with a value wins"`
+	Rib_fname              string   `yaml:"rib_fname" env:"ECS_RIB_FNAME" env-description:"routed prefixes gen-subnets builds the subnet list from, a caida pfx2as dump or an mrt rib dump, plain, gzip or bzip2"`
+	Gen_prefix_v4          int      `yaml:"gen_prefix_v4" env:"ECS_GEN_PREFIX_V4" env-default:"24" env-description:"length of the ipv4 subnets gen-subnets writes, 0 for none"`
+	Gen_prefix_v6          int      `yaml:"gen_prefix_v6" env:"ECS_GEN_PREFIX_V6" env-default:"48" env-description:"length of the ipv6 subnets gen-subnets writes, 0 for none"`
+	Gen_exclude_asns       []string `yaml:"gen_exclude_asns" env:"ECS_GEN_EXCLUDE_ASNS" env-separator:"," env-description:"origin ases (e.g. AS13335 or 13335) whose prefixes gen-subnets skips"`
+	Gen_exclude_countries  []string `yaml:"gen_exclude_countries" env:"ECS_GEN_EXCLUDE_COUNTRIES" env-separator:"," env-description:"country iso codes whose prefixes gen-subnets skips"`
+	Capture                bool     `yaml:"capture" env:"ECS_CAPTURE" env-description:"record all dns messages to a pcapng file, tied to the rows by query id"`
+	Metrics_listen         string   `yaml:"metrics_listen" env:"ECS_METRICS_LISTEN" env-description:"address to serve prometheus metrics on (/metrics), empty to disable"`
+	Profiles               []string `yaml:"profiles" env:"ECS_PROFILES" env-separator:"," env-description:"profiles written per phase, any of cpu, heap, goroutine, mutex and block"`
+	Profile_dir            string   `yaml:"profile_dir" env:"ECS_PROFILE_DIR" env-default:"." env-description:"directory the profiles are written to"`
+	Block_profile_rate     int      `yaml:"block_profile_rate" env:"ECS_BLOCK_PROFILE_RATE" env-default:"10000" env-description:"block profile samples one blocking event per this many nanoseconds blocked"`
+	Mutex_profile_fraction int      `yaml:"mutex_profile_fraction" env:"ECS_MUTEX_PROFILE_FRACTION" env-default:"10" env-description:"mutex profile samples one in this many contention events"`
+	Pprof_listen           string   `yaml:"pprof_listen" env:"ECS_PPROF_LISTEN" env-description:"address to serve live profiles on (/debug/pprof/), empty to disable"`
+	Progress_interval      int      `yaml:"progress_interval" env:"ECS_PROGRESS_INTERVAL" env-default:"30" env-description:"seconds between progress lines on stderr, 0 to disable"`
+}
+
+var cfg cfg_db
+
+func load_config(path string) error {
+	err := cleanenv.ReadConfig(path, &cfg)
+	if err != nil {
+		return fmt.Errorf("loading config %s: %w", path, err)
+	}
+	return nil
+}
+
+// prints every config key with its environment variable, default and description
+func print_config_env() {
+	header := "environment variables:"
+	cleanenv.FUsage(os.Stdout, &cfg, &header)()
+}
+
+// checks the semantics of the loaded config
+// required lists the keys the current subcommand cannot work without;
+// file names among them additionally have to exist
+// all problems are collected, so they can be fixed in one go
+func validate_config(required ...string) error {
+	errs := make([]error, 0)
+	check := func(ok bool, format string, v ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, v...))
+		}
+	}
+	check(cfg.Verbosity >= 0 && cfg.Verbosity <= 5, "verbosity must be between 0 and 5, got %d", cfg.Verbosity)
+	check(cfg.Log_format == "text" || cfg.Log_format == "json", "log_format must be text or json, got %q", cfg.Log_format)
+	if _, err := parse_log_levels(cfg.Log_levels); err != nil {
+		errs = append(errs, err)
+	}
+	check(cfg.Number_of_domains == -1 || cfg.Number_of_domains > 0, "no_of_domains must be -1 or positive, got %d", cfg.Number_of_domains)
+	check(cfg.Simul_ecs_reqs > 0, "simul_ecs_reqs must be at least 1, got %d", cfg.Simul_ecs_reqs)
+	check(cfg.Simul_ns_reqs > 0, "simul_ns_reqs must be at least 1, got %d", cfg.Simul_ns_reqs)
+	check(cfg.Query_timeout_ms > 0, "query_timeout_ms must be positive, got %d", cfg.Query_timeout_ms)
+	check(slices.Contains(ecs.Transport_names, cfg.Transport), "transport must be one of %s, got %q", strings.Join(ecs.Transport_names, ","), cfg.Transport)
+	check(cfg.Transport_port >= 0 && cfg.Transport_port <= 65535, "transport_port must be between 0 and 65535, got %d", cfg.Transport_port)
+	for _, addr := range cfg.Source_addrs {
+		check(net.ParseIP(addr) != nil, "source_addrs must be ip addresses, got %q", addr)
+	}
+	check(cfg.Resolve_timeout >= 0, "resolve_timeout must not be negative, got %d", cfg.Resolve_timeout)
+	check(cfg.Phase_timeout >= 0, "phase_timeout must not be negative, got %d", cfg.Phase_timeout)
+	check(cfg.Run_timeout >= 0, "run_timeout must not be negative, got %d", cfg.Run_timeout)
+	check(slices.Contains(ecs.Scheduler_names, cfg.Schedule), "schedule must be one of %s, got %q", strings.Join(ecs.Scheduler_names, ","), cfg.Schedule)
+	check(cfg.Repeat_queries > 0, "repeat_queries must be at least 1, got %d", cfg.Repeat_queries)
+	check(cfg.Repeat_spacing_ms >= 0, "repeat_spacing_ms must not be negative, got %d", cfg.Repeat_spacing_ms)
+	check(cfg.Rounds >= 0, "rounds must not be negative, got %d", cfg.Rounds)
+	check(cfg.Round_interval >= 0, "round_interval must not be negative, got %d", cfg.Round_interval)
+	check(cfg.Resolve_every > 0, "resolve_every must be at least 1, got %d", cfg.Resolve_every)
+	check(cfg.Gen_prefix_v4 >= 0 && cfg.Gen_prefix_v4 <= 32, "gen_prefix_v4 must be between 0 and 32, got %d", cfg.Gen_prefix_v4)
+	check(cfg.Gen_prefix_v6 >= 0 && cfg.Gen_prefix_v6 <= 128, "gen_prefix_v6 must be between 0 and 128, got %d", cfg.Gen_prefix_v6)
+	check(cfg.Gen_prefix_v4 != 0 || cfg.Gen_prefix_v6 != 0, "gen_prefix_v4 and gen_prefix_v6 must not both be 0")
+	for _, asn := range cfg.Gen_exclude_asns {
+		_, err := parse_asn(asn)
+		check(err == nil, "gen_exclude_asns must be as numbers, got %q", asn)
+	}
+	check(cfg.Progress_interval >= 0, "progress_interval must not be negative, got %d", cfg.Progress_interval)
+	check(cfg.Intermediate_depth >= 0, "intermediate_depth must not be negative, got %d", cfg.Intermediate_depth)
+	if err := validate_sinks(cfg.Output_sinks); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validate_profiles(cfg.Profiles); err != nil {
+		errs = append(errs, err)
+	}
+	check(cfg.Block_profile_rate > 0, "block_profile_rate must be positive, got %d", cfg.Block_profile_rate)
+	check(cfg.Mutex_profile_fraction > 0, "mutex_profile_fraction must be positive, got %d", cfg.Mutex_profile_fraction)
+	check(cfg.Pprof_listen == "" || cfg.Pprof_listen != cfg.Metrics_listen, "pprof_listen and metrics_listen must differ, both are %q", cfg.Pprof_listen)
+	check(strings.Contains(cfg.Output_name, "{kind}"), "output_name must contain {kind}, got %q", cfg.Output_name)
+
+	files := map[string]bool{
+		"toplist_fname":    true,
+		"subnets_fname":    true,
+		"nameserver_fname": true,
+		"resolvers_fname":  true,
+		"rib_fname":        true,
+	}
+	for _, key := range required {
+		field, ok := cfg_field(key)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown config key %s", key))
+			continue
+		}
+		if field.Kind() == reflect.Slice {
+			if field.Len() == 0 {
+				errs = append(errs, fmt.Errorf("%s must be set", key))
+			}
+			continue
+		}
+		value := field.String()
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", key))
+			continue
+		}
+		if !files[key] {
+			continue
+		}
+		if info, err := os.Stat(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		} else if info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s: %s is a directory", key, value))
+		}
+	}
+	for _, path := range cfg.Mmdb_paths {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("mmdb_paths: %w", err))
+		}
+	}
+	if cfg.Blocklist_path != "" {
+		if _, err := os.Stat(cfg.Blocklist_path); err != nil {
+			log_main.Warn("blocklist not readable", "path", cfg.Blocklist_path, "err", err)
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// sets cfg to the defaults of its env-default tags, the previous cfg is restored
+// after the test
+func default_config(t *testing.T) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg = cfg_db{}
+	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the single errors joined into the error of validate_config
+func config_errors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	joined, ok := errors.Unwrap(err).(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	return joined.Unwrap()
+}
+
+func TestValidateConfigRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func()
+		err    string // empty if the config is valid
+	}{
+		{"defaults", func() {}, ""},
+		{"verbosity too low", func() { cfg.Verbosity = -1 }, "verbosity must be between 0 and 5"},
+		{"verbosity too high", func() { cfg.Verbosity = 6 }, "verbosity must be between 0 and 5"},
+		{"log format", func() { cfg.Log_format = "xml" }, "log_format must be text or json"},
+		{"log levels", func() { cfg.Log_levels = []string{"resolver=loud"} }, "resolver"},
+		{"no of domains 0", func() { cfg.Number_of_domains = 0 }, "no_of_domains must be -1 or positive"},
+		{"no of domains -2", func() { cfg.Number_of_domains = -2 }, "no_of_domains must be -1 or positive"},
+		{"simul ecs reqs", func() { cfg.Simul_ecs_reqs = 0 }, "simul_ecs_reqs must be at least 1"},
+		{"simul ns reqs", func() { cfg.Simul_ns_reqs = 0 }, "simul_ns_reqs must be at least 1"},
+		{"query timeout", func() { cfg.Query_timeout_ms = 0 }, "query_timeout_ms must be positive"},
+		{"transport", func() { cfg.Transport = "quic" }, "transport must be one of"},
+		{"transport port negative", func() { cfg.Transport_port = -1 }, "transport_port must be between 0 and 65535"},
+		{"transport port too high", func() { cfg.Transport_port = 65536 }, "transport_port must be between 0 and 65535"},
+		{"source addrs", func() { cfg.Source_addrs = []string{"192.0.2.1", "eth0"} }, `source_addrs must be ip addresses, got "eth0"`},
+		{"resolve timeout", func() { cfg.Resolve_timeout = -1 }, "resolve_timeout must not be negative"},
+		{"phase timeout", func() { cfg.Phase_timeout = -1 }, "phase_timeout must not be negative"},
+		{"run timeout", func() { cfg.Run_timeout = -1 }, "run_timeout must not be negative"},
+		{"schedule", func() { cfg.Schedule = "fifo" }, "schedule must be one of"},
+		{"repeat queries", func() { cfg.Repeat_queries = 0 }, "repeat_queries must be at least 1"},
+		{"repeat spacing", func() { cfg.Repeat_spacing_ms = -1 }, "repeat_spacing_ms must not be negative"},
+		{"rounds", func() { cfg.Rounds = -1 }, "rounds must not be negative"},
+		{"round interval", func() { cfg.Round_interval = -1 }, "round_interval must not be negative"},
+		{"resolve every", func() { cfg.Resolve_every = 0 }, "resolve_every must be at least 1"},
+		{"gen prefix v4", func() { cfg.Gen_prefix_v4 = 33 }, "gen_prefix_v4 must be between 0 and 32"},
+		{"gen prefix v6", func() { cfg.Gen_prefix_v6 = 129 }, "gen_prefix_v6 must be between 0 and 128"},
+		{"gen prefixes both 0", func() { cfg.Gen_prefix_v4, cfg.Gen_prefix_v6 = 0, 0 }, "must not both be 0"},
+		{"gen exclude asns", func() { cfg.Gen_exclude_asns = []string{"AS13335", "cloudflare"} }, `gen_exclude_asns must be as numbers, got "cloudflare"`},
+		{"progress interval", func() { cfg.Progress_interval = -1 }, "progress_interval must not be negative"},
+		{"intermediate depth", func() { cfg.Intermediate_depth = -1 }, "intermediate_depth must not be negative"},
+		{"no sinks", func() { cfg.Output_sinks = []string{} }, "output_sinks must not be empty"},
+		{"unknown sink", func() { cfg.Output_sinks = []string{"kafka"} }, "kafka"},
+		{"unknown profile", func() { cfg.Profiles = []string{"threads"} }, `unknown profile "threads"`},
+		{"block profile rate", func() { cfg.Block_profile_rate = 0 }, "block_profile_rate must be positive"},
+		{"mutex profile fraction", func() { cfg.Mutex_profile_fraction = 0 }, "mutex_profile_fraction must be positive"},
+		{"pprof on the metrics address", func() { cfg.Pprof_listen, cfg.Metrics_listen = ":9100", ":9100" }, "pprof_listen and metrics_listen must differ"},
+		{"output name", func() { cfg.Output_name = "{run}" }, "output_name must contain {kind}"},
+		{"missing mmdb", func() { cfg.Mmdb_paths = []string{filepath.Join(t.TempDir(), "missing.mmdb")} }, "mmdb_paths: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			default_config(t)
+			test.modify()
+			errs := config_errors(validate_config())
+			if test.err == "" {
+				if len(errs) != 0 {
+					t.Errorf("errors for a valid config: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.err) {
+				t.Errorf("errors = %v, want one with %q", errs, test.err)
+			}
+		})
+	}
+}
+
+func TestValidateConfigRequired(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "exists.txt")
+	if err := os.WriteFile(existing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.txt")
+	commands := make(map[string]*subcommand)
+	for _, cmd := range subcommands {
+		commands[cmd.name] = cmd
+	}
+	tests := []struct {
+		command string
+		modify  func()
+		errs    []string // one per expected error
+	}{
+		{"full", func() { cfg.Toplist_fname, cfg.Subnets_fname = existing, existing }, nil},
+		{"full", func() { cfg.Toplist_fname, cfg.Subnets_fname = missing, "" },
+			[]string{"toplist_fname: ", "subnets_fname must be set"}},
+		{"full", func() { cfg.Toplist_fname, cfg.Subnets_fname = dir, existing }, []string{"is a directory"}},
+		{"resolve-ns", func() { cfg.Toplist_fname, cfg.Nameserver_fname = existing, "" }, []string{"nameserver_fname must be set"}},
+		{"scan-ecs", func() { cfg.Nameserver_fname, cfg.Subnets_fname = missing, existing }, []string{"nameserver_fname: "}},
+		{"repeat", func() { cfg.Toplist_fname, cfg.Subnets_fname = existing, existing }, nil},
+		{"diff", func() { cfg.Toplist_fname = missing }, nil},
+		{"report", func() { cfg.Toplist_fname = missing }, nil},
+		{"enrich", func() {}, []string{"mmdb_paths must be set"}},
+		{"gen-subnets", func() { cfg.Rib_fname = missing }, []string{"rib_fname: ", "mmdb_paths must be set"}},
+		{"probe", func() {}, nil},
+		{"probe-resolvers", func() { cfg.Resolvers_fname, cfg.Subnets_fname = existing, existing },
+			[]string{"probe_zone must be set"}},
+		{"probe-resolvers", func() {
+			cfg.Resolvers_fname, cfg.Subnets_fname, cfg.Probe_zone = existing, existing, "echo.test"
+		}, nil},
+		{"echo-server", func() { cfg.Echo_listen = "" }, []string{"echo_zone must be set", "echo_listen must be set"}},
+		{"echo-server", func() { cfg.Echo_zone = "echo.test" }, nil},
+		{"verify-config", func() {}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			default_config(t)
+			test.modify()
+			cmd, ok := commands[test.command]
+			if !ok {
+				t.Fatalf("no subcommand %s", test.command)
+			}
+			errs := config_errors(validate_config(cmd.required...))
+			if len(errs) != len(test.errs) {
+				t.Fatalf("errors = %v, want %d", errs, len(test.errs))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), test.errs[i]) {
+					t.Errorf("error %d = %v, want %q", i, err, test.errs[i])
+				}
+			}
+		})
+	}
+	default_config(t)
+	if errs := config_errors(validate_config("no_such_key")); len(errs) != 1 || !strings.Contains(errs[0].Error(), "unknown config key no_such_key") {
+		t.Errorf("errors = %v for an unknown key", errs)
+	}
+}
+
+// every problem is reported, not only the first one
+func TestValidateConfigJoined(t *testing.T) {
+	default_config(t)
+	cfg.Verbosity = 9
+	cfg.Simul_ecs_reqs = 0
+	cfg.Transport = "quic"
+	cfg.Output_name = "scan"
+	err := validate_config("probe_zone")
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid config:\n") {
+		t.Fatalf("err = %v", err)
+	}
+	want := []string{"verbosity", "simul_ecs_reqs", "transport", "output_name", "probe_zone"}
+	errs := config_errors(err)
+	if len(errs) != len(want) {
+		t.Fatalf("errors = %v, want %d", errs, len(want))
+	}
+	for i, key := range want {
+		if !strings.HasPrefix(errs[i].Error(), key) {
+			t.Errorf("error %d = %v, want one about %s", i, errs[i], key)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// scan diff
+// compares two scan.csv.gz files, e.g. two rounds of repeat, and reports the domains
+// and nameservers that started or stopped answering with ecs, changed their scope or
+// their answers. the answers of repeated queries are merged, the questions are
+// compared by (domain, subnet), so that a changed nameserver does not hide them
+
+// (domain, nameserver) or (domain, subnet)
+type diff_key struct {
+	domain string
+	other  string
+}
+
+type diff_scan struct {
+	nameservers map[string]map[string]bool   // domain -> nameservers
+	ecs         map[diff_key]bool            // (domain, nameserver) -> answered with ecs at least once
+	scopes      map[diff_key]map[string]bool // (domain, subnet) -> returned scopes
+	answers     map[diff_key]map[string]bool // (domain, subnet) -> returned ips
+}
+
+// a single difference, written as kind;domain;nameserver;subnet;old;new
+type diff_change struct {
+	kind       string
+	domain     string
+	nameserver string
+	subnet     string
+	old        string
+	new        string
+}
+
+type diff_kind struct {
+	name  string
+	title string
+}
+
+var diff_kinds = []diff_kind{
+	{"removed", "domains only in the old scan"},
+	{"added", "domains only in the new scan"},
+	{"nameserver", "domains whose nameservers changed"},
+	{"ecs_started", "nameservers that started answering with ecs"},
+	{"ecs_stopped", "nameservers that stopped answering with ecs"},
+	{"scope", "questions whose returned scope changed"},
+	{"answers", "questions whose answers changed"},
+}
+
+func add_to_set(sets map[diff_key]map[string]bool, key diff_key, values ...string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		sets[key] = set
+	}
+	for _, value := range values {
+		set[value] = true
+	}
+}
+
+// the sorted members of set, joined by commas
+func set_str(set map[string]bool) string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	slices.Sort(members)
+	return strings.Join(members, ",")
+}
+
+func read_scan(path string) (*diff_scan, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zip_reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer zip_reader.Close()
+
+	scan := &diff_scan{
+		nameservers: make(map[string]map[string]bool),
+		ecs:         make(map[diff_key]bool),
+		scopes:      make(map[diff_key]map[string]bool),
+		answers:     make(map[diff_key]map[string]bool),
+	}
+	csv_reader := csv.NewReader(zip_reader)
+	csv_reader.Comma = ';'
+	csv_reader.FieldsPerRecord = -1
+	for {
+		records, err := csv_reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(records) < 7 {
+			line, _ := csv_reader.FieldPos(0)
+			return nil, fmt.Errorf("%s:%d: expected at least 7 fields, got %d", path, line, len(records))
+		}
+		domain, nameserver, subnet := records[1], records[2], records[3]
+		if _, ok := scan.nameservers[domain]; !ok {
+			scan.nameservers[domain] = make(map[string]bool)
+		}
+		scan.nameservers[domain][nameserver] = true
+		ns_key := diff_key{domain, nameserver}
+		scan.ecs[ns_key] = scan.ecs[ns_key] || records[4] != ""
+		question := diff_key{domain, subnet}
+		if records[5] != "" {
+			add_to_set(scan.scopes, question, records[5])
+		}
+		if records[6] != "" {
+			add_to_set(scan.answers, question, strings.Split(records[6], ",")...)
+		}
+	}
+	return scan, nil
+}
+
+// compares the sets of the questions asked in both scans, unanswered ones are skipped
+func diff_sets(kind string, old_sets map[diff_key]map[string]bool, new_sets map[diff_key]map[string]bool) []*diff_change {
+	changes := make([]*diff_change, 0)
+	for key, old_set := range old_sets {
+		new_set, ok := new_sets[key]
+		if !ok {
+			continue
+		}
+		if old_str, new_str := set_str(old_set), set_str(new_set); old_str != new_str {
+			changes = append(changes, &diff_change{kind: kind, domain: key.domain, subnet: key.other, old: old_str, new: new_str})
+		}
+	}
+	return changes
+}
+
+func diff_scans(old_scan *diff_scan, new_scan *diff_scan) []*diff_change {
+	changes := make([]*diff_change, 0)
+	for domain, old_nss := range old_scan.nameservers {
+		new_nss, ok := new_scan.nameservers[domain]
+		if !ok {
+			changes = append(changes, &diff_change{kind: "removed", domain: domain, old: set_str(old_nss)})
+			continue
+		}
+		if old_str, new_str := set_str(old_nss), set_str(new_nss); old_str != new_str {
+			changes = append(changes, &diff_change{kind: "nameserver", domain: domain, old: old_str, new: new_str})
+		}
+	}
+	for domain, new_nss := range new_scan.nameservers {
+		if _, ok := old_scan.nameservers[domain]; !ok {
+			changes = append(changes, &diff_change{kind: "added", domain: domain, new: set_str(new_nss)})
+		}
+	}
+	for key, old_ecs := range old_scan.ecs {
+		new_ecs, ok := new_scan.ecs[key]
+		if !ok || old_ecs == new_ecs {
+			continue
+		}
+		kind := "ecs_started"
+		if old_ecs {
+			kind = "ecs_stopped"
+		}
+		changes = append(changes, &diff_change{kind: kind, domain: key.domain, nameserver: key.other,
+			old: fmt.Sprint(old_ecs), new: fmt.Sprint(new_ecs)})
+	}
+	changes = append(changes, diff_sets("scope", old_scan.scopes, new_scan.scopes)...)
+	changes = append(changes, diff_sets("answers", old_scan.answers, new_scan.answers)...)
+
+	kind_index := func(kind string) int {
+		return slices.IndexFunc(diff_kinds, func(k diff_kind) bool { return k.name == kind })
+	}
+	slices.SortFunc(changes, func(a *diff_change, b *diff_change) int {
+		if a.kind != b.kind {
+			return kind_index(a.kind) - kind_index(b.kind)
+		}
+		if a.domain != b.domain {
+			return strings.Compare(a.domain, b.domain)
+		}
+		if a.nameserver != b.nameserver {
+			return strings.Compare(a.nameserver, b.nameserver)
+		}
+		return strings.Compare(a.subnet, b.subnet)
+	})
+	return changes
+}
+
+func (change *diff_change) to_csv_strarr() []string {
+	return []string{change.kind, change.domain, change.nameserver, change.subnet, change.old, change.new}
+}
+
+func (change *diff_change) line() string {
+	switch {
+	case change.subnet != "":
+		return fmt.Sprintf("%s %s: %s -> %s", change.domain, change.subnet, change.old, change.new)
+	case change.nameserver != "":
+		return fmt.Sprintf("%s %s", change.domain, change.nameserver)
+	case change.old == "":
+		return fmt.Sprintf("%s (%s)", change.domain, change.new)
+	case change.new == "":
+		return fmt.Sprintf("%s (%s)", change.domain, change.old)
+	}
+	return fmt.Sprintf("%s: %s -> %s", change.domain, change.old, change.new)
+}
+
+// prints the number of changes of every kind and up to limit of them, 0 for all
+func print_diff(w io.Writer, changes []*diff_change, limit int) {
+	for _, kind := range diff_kinds {
+		of_kind := make([]*diff_change, 0)
+		for _, change := range changes {
+			if change.kind == kind.name {
+				of_kind = append(of_kind, change)
+			}
+		}
+		fmt.Fprintf(w, "%s: %d\n", kind.title, len(of_kind))
+		for i, change := range of_kind {
+			if limit > 0 && i == limit {
+				fmt.Fprintf(w, "  ... %d more\n", len(of_kind)-limit)
+				break
+			}
+			fmt.Fprintln(w, " ", change.line())
+		}
+	}
+}
+
+// the csv format will be as follows:
+// kind;domain;[nameserver];[subnet];[old];[new]
+func write_changes(path string, changes []*diff_change) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zip_writer := gzip.NewWriter(file)
+	csv_writer := csv.NewWriter(zip_writer)
+	csv_writer.Comma = ';'
+	for _, change := range changes {
+		if err := csv_writer.Write(change.to_csv_strarr()); err != nil {
+			return err
+		}
+	}
+	csv_writer.Flush()
+	return errors.Join(csv_writer.Error(), zip_writer.Close())
+}
+
+func cmd_diff(args []string) error {
+	fs := new_flag_set("diff", "<old.csv.gz> <new.csv.gz>")
+	limit := fs.Int("limit", 20, "changes listed per kind, 0 for all")
+	changes_path := fs.String("changes", "", "also write all changes to this csv.gz file")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("diff needs the old and the new scan file")
+	}
+	old_scan, err := read_scan(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	new_scan, err := read_scan(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("old: %s (%d domains)\n", fs.Arg(0), len(old_scan.nameservers))
+	fmt.Printf("new: %s (%d domains)\n", fs.Arg(1), len(new_scan.nameservers))
+	changes := diff_scans(old_scan, new_scan)
+	print_diff(os.Stdout, changes, *limit)
+	if *changes_path != "" {
+		if err := write_changes(*changes_path, changes); err != nil {
+			return err
+		}
+		fmt.Println("changes written to", *changes_path)
+	}
+	return nil
+}
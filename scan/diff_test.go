@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// a scan row of domain, nameserver, subnet, returned subnet, scope and answers
+func diff_row(domain string, nameserver string, subnet string, ans_subnet string, scope string, ips string) []string {
+	return []string{"2026-01-01 00:00:00.000000", domain, nameserver, subnet, ans_subnet, scope, ips, "1", "10.000", ""}
+}
+
+func TestDiffScans(t *testing.T) {
+	const subnet = "203.0.113.0/24"
+	old_rows := [][]string{
+		diff_row("a.test", "192.0.2.1", subnet, subnet, "24", "198.51.100.1"),
+		diff_row("a.test", "192.0.2.1", "198.18.0.0/24", subnet, "24", "198.51.100.9"),
+		diff_row("removed.test", "192.0.2.2", subnet, "", "", "198.51.100.2"),
+		diff_row("started.test", "192.0.2.3", subnet, "", "", "198.51.100.3"),
+		diff_row("stopped.test", "192.0.2.4", subnet, subnet, "0", "198.51.100.4"),
+		diff_row("moved.test", "192.0.2.5", subnet, subnet, "24", "198.51.100.5"),
+		// unanswered in the old scan, the ecs started but scope and answers did not change
+		diff_row("unanswered.test", "192.0.2.7", subnet, "", "", ""),
+	}
+	new_rows := [][]string{
+		// a repeated query, its answers are merged
+		diff_row("a.test", "192.0.2.1", subnet, subnet, "16", "198.51.100.1"),
+		diff_row("a.test", "192.0.2.1", subnet, subnet, "16", "198.51.100.11"),
+		diff_row("a.test", "192.0.2.1", "198.18.0.0/24", subnet, "24", "198.51.100.9"),
+		diff_row("started.test", "192.0.2.3", subnet, subnet, "24", "198.51.100.3"),
+		diff_row("stopped.test", "192.0.2.4", subnet, "", "", "198.51.100.4"),
+		diff_row("moved.test", "192.0.2.6", subnet, subnet, "24", "198.51.100.5"),
+		diff_row("unanswered.test", "192.0.2.7", subnet, subnet, "24", "198.51.100.7"),
+		diff_row("added.test", "192.0.2.8", subnet, "", "", "198.51.100.8"),
+	}
+	dir := t.TempDir()
+	old_path, new_path := filepath.Join(dir, "old.csv.gz"), filepath.Join(dir, "new.csv.gz")
+	write_gz_csv(t, old_path, old_rows)
+	write_gz_csv(t, new_path, new_rows)
+	old_scan, err := read_scan(old_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_scan, err := read_scan(new_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		old, new *diff_scan
+		want     [][]string
+	}{
+		{"changes", old_scan, new_scan, [][]string{
+			{"removed", "removed.test", "", "", "192.0.2.2", ""},
+			{"added", "added.test", "", "", "", "192.0.2.8"},
+			{"nameserver", "moved.test", "", "", "192.0.2.5", "192.0.2.6"},
+			{"ecs_started", "started.test", "192.0.2.3", "", "false", "true"},
+			{"ecs_started", "unanswered.test", "192.0.2.7", "", "false", "true"},
+			{"ecs_stopped", "stopped.test", "192.0.2.4", "", "true", "false"},
+			{"scope", "a.test", "", subnet, "24", "16"},
+			{"answers", "a.test", "", subnet, "198.51.100.1", "198.51.100.1,198.51.100.11"},
+		}},
+		{"reversed", new_scan, old_scan, [][]string{
+			{"removed", "added.test", "", "", "192.0.2.8", ""},
+			{"added", "removed.test", "", "", "", "192.0.2.2"},
+			{"nameserver", "moved.test", "", "", "192.0.2.6", "192.0.2.5"},
+			{"ecs_started", "stopped.test", "192.0.2.4", "", "false", "true"},
+			{"ecs_stopped", "started.test", "192.0.2.3", "", "true", "false"},
+			{"ecs_stopped", "unanswered.test", "192.0.2.7", "", "true", "false"},
+			{"scope", "a.test", "", subnet, "16", "24"},
+			{"answers", "a.test", "", subnet, "198.51.100.1,198.51.100.11", "198.51.100.1"},
+		}},
+		{"unchanged", old_scan, old_scan, [][]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := diff_scans(test.old, test.new)
+			got := make([][]string, 0, len(changes))
+			for _, change := range changes {
+				got = append(got, change.to_csv_strarr())
+			}
+			if !slices.EqualFunc(got, test.want, slices.Equal[[]string]) {
+				t.Errorf("changes\n got %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadScanShortRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short.csv.gz")
+	write_gz_csv(t, path, [][]string{diff_row("a.test", "192.0.2.1", "203.0.113.0/24", "", "", ""), {"2026-01-01", "b.test", "192.0.2.2"}})
+	if _, err := read_scan(path); err == nil {
+		t.Error("no error for a row with 3 fields")
+	}
+}
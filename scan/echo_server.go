@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ecs echo authoritative
+// answers every name below echo_zone with what it received:
+// TXT -> the echo format described in resolver_probe.go
+// A   -> the ecs address if there was one, the address of the querying resolver otherwise
+// every query is logged to echo.csv.gz
+
+type echo_item struct {
+	timestamp  time.Time
+	qname      string
+	qtype      uint16
+	src_ip     net.IP
+	ecs_family uint16
+	ecs_subnet *net.IPNet
+}
+
+var write_echo_chan = make(chan *echo_item, 4096)
+
+// the csv format will be as follows:
+// timestamp;qname;resolver-ip;qtype;[ecs-subnet-cidr];[ecs-family]
+func (item *echo_item) to_csv_strarr() []string {
+	ret_str := make([]string, 6)
+	ret_str[0] = item.timestamp.Format("2006-01-02 15:04:05.000000")
+	ret_str[1] = item.qname
+	ret_str[2] = item.src_ip.String()
+	ret_str[3] = dns.TypeToString[item.qtype]
+	if item.ecs_subnet != nil {
+		ret_str[4] = item.ecs_subnet.String()
+		ret_str[5] = strconv.Itoa(int(item.ecs_family))
+	}
+	return ret_str
+}
+
+// the TXT strings parse_echo_txt understands
+func (item *echo_item) to_txt() []string {
+	ecs_str := "ecs=none"
+	if item.ecs_subnet != nil {
+		ones, _ := item.ecs_subnet.Mask.Size()
+		ecs_str = "ecs=" + strconv.Itoa(int(item.ecs_family)) + "/" + item.ecs_subnet.IP.String() + "/" + strconv.Itoa(ones)
+	}
+	return []string{
+		ecs_str,
+		"src=" + item.src_ip.String(),
+		"ts=" + strconv.FormatInt(item.timestamp.UnixNano(), 10),
+	}
+}
+
+func writeout_echo(ctx context.Context) {
+	if err := os.MkdirAll(cfg.Output_dir, 0755); err != nil {
+		panic(err)
+	}
+	csvfile, err := os.Create(output_path("echo", ".csv.gz"))
+	if err != nil {
+		panic(err)
+	}
+	defer csvfile.Close()
+
+	zip_writer := gzip.NewWriter(csvfile)
+	defer zip_writer.Close()
+
+	writer := csv.NewWriter(zip_writer)
+	writer.Comma = ';'
+	defer writer.Flush()
+
+	write := func(item *echo_item) {
+		out_str := item.to_csv_strarr()
+		log_writer.Debug("writing echo item", "row", out_str)
+		writer.Write(out_str)
+	}
+	for {
+		select {
+		case item := <-write_echo_chan:
+			write(item)
+			// queries trickle in slowly, so we dont want them to sit in the buffer
+			writer.Flush()
+			zip_writer.Flush()
+		case <-ctx.Done():
+			// write what is still waiting in the channel
+			for {
+				select {
+				case item := <-write_echo_chan:
+					write(item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func remote_ip(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+func echo_handler(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		w.WriteMsg(resp)
+		return
+	}
+	question := req.Question[0]
+	zone := dns.Fqdn(strings.Trim(cfg.Echo_zone, "."))
+	if !dns.IsSubDomain(zone, strings.ToLower(question.Name)) {
+		resp.Authoritative = false
+		resp.Rcode = dns.RcodeRefused
+		w.WriteMsg(resp)
+		return
+	}
+
+	item := &echo_item{
+		timestamp: time.Now(),
+		qname:     strings.TrimSuffix(question.Name, "."),
+		qtype:     question.Qtype,
+		src_ip:    remote_ip(w),
+	}
+	var ecs *dns.EDNS0_SUBNET = nil
+	if opt := req.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if e, ok := option.(*dns.EDNS0_SUBNET); ok {
+				ecs = e
+				bits := 32
+				if e.Family == 2 {
+					bits = 128
+				}
+				item.ecs_family = e.Family
+				item.ecs_subnet = &net.IPNet{IP: e.Address, Mask: net.CIDRMask(int(e.SourceNetmask), bits)}
+				break
+			}
+		}
+		// answer with edns as well and echo the ecs option with the full source prefix as scope
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		if ecs != nil {
+			resp_ecs := *ecs
+			resp_ecs.SourceScope = ecs.SourceNetmask
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &resp_ecs)
+		}
+	}
+	write_echo_chan <- item
+
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 0}
+	switch question.Qtype {
+	case dns.TypeTXT:
+		resp.Answer = append(resp.Answer, &dns.TXT{Hdr: hdr, Txt: item.to_txt()})
+	case dns.TypeA:
+		var ip net.IP = nil
+		if item.ecs_subnet != nil {
+			ip = item.ecs_subnet.IP.To4()
+		} else if item.src_ip != nil {
+			ip = item.src_ip.To4()
+		}
+		if ip != nil {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+		}
+	}
+	log_echo.Debug("echo answering", "src", item.src_ip, "qname", item.qname, "subnet", item.ecs_subnet)
+	if err := w.WriteMsg(resp); err != nil {
+		log_echo.Error("writing echo answer", "err", err)
+	}
+}
+
+func serve_echo() error {
+	start_writer(writeout_echo)
+	dns.HandleFunc(".", echo_handler)
+	errs := make(chan error, 2)
+	servers := make([]*dns.Server, 0, 2)
+	for _, proto := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: cfg.Echo_listen, Net: proto}
+		servers = append(servers, server)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	log_echo.Info("echo server listening", "zone", cfg.Echo_zone, "listen", cfg.Echo_listen)
+	var err error = nil
+	select {
+	case err = <-errs:
+	case <-run_ctx.Done():
+		log_echo.Info("stopping echo server")
+	}
+	for _, server := range servers {
+		server.Shutdown()
+	}
+	close_writers()
+	return err
+}
@@ -0,0 +1,279 @@
+package ecs
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// dns_cache needs to be a tree (typical dns tree)
+//
+//	        .
+//	       / \
+//	     com  org
+//	    /   \
+//	google   amazon
+type dns_rr struct {
+	nss   []string
+	ips   []net.IP
+	cname string
+}
+type cache_node struct {
+	node_name    string
+	next         []*cache_node
+	rr           *dns_rr
+	intermediate bool
+}
+
+// intermediate_depth is the number of single character nodes per label, they keep
+// the number of children per node small for huge zones like com
+type dns_cache struct {
+	root               cache_node
+	mu                 sync.Mutex
+	intermediate_depth int
+	logger             func() *slog.Logger
+}
+
+func new_dns_cache(intermediate_depth int, logger func() *slog.Logger) *dns_cache {
+	return &dns_cache{
+		root: cache_node{
+			node_name: ".",
+			next:      make([]*cache_node, 0),
+			rr: &dns_rr{
+				nss: make([]string, 0),
+			},
+			intermediate: false,
+		},
+		intermediate_depth: intermediate_depth,
+		logger:             logger,
+	}
+}
+
+// drops everything but the root
+func (cache *dns_cache) flush() {
+	cache.mu.Lock()
+	cache.root.next = make([]*cache_node, 0)
+	cache.mu.Unlock()
+}
+
+func (parent *cache_node) preorder(level int, fn func(level int, name string, nss []string, ips []net.IP, intermediate bool)) {
+	if parent.intermediate {
+		fn(level, parent.node_name, nil, nil, true)
+	} else {
+		fn(level, parent.node_name, parent.rr.nss, parent.rr.ips, false)
+	}
+	for _, child := range parent.next {
+		child.preorder(level+1, fn)
+	}
+}
+
+func (cache *dns_cache) create_node(domain string) *cache_node {
+	domain = strings.ToLower(domain)
+	domain_split := strings.Split(domain, ".")
+	next_node_name := pop(&domain_split)
+	rune_name := []rune(next_node_name)
+	cur_node := &cache.root
+	inter_pos := 0
+	for {
+		var found_node *cache_node = nil
+		for _, node := range cur_node.next {
+			if node.intermediate {
+				if inter_pos == len(rune_name) {
+					continue
+				}
+				if node.node_name == string(rune_name[inter_pos]) {
+					found_node = node
+					break
+				}
+			} else {
+				if node.node_name == next_node_name {
+					found_node = node
+					break
+				}
+			}
+		}
+		// if we couldnt find the node
+		if found_node == nil {
+			// if either the max intermediate depth is reached or the rune name is exhausted -> create a normal node
+			if cache.intermediate_depth == inter_pos || inter_pos == len(rune_name) {
+				// we need to create it
+				found_node = &cache_node{
+					node_name: next_node_name,
+					next:      make([]*cache_node, 0),
+					rr: &dns_rr{
+						ips: make([]net.IP, 0),
+					},
+					intermediate: false,
+				}
+			} else {
+				found_node = &cache_node{
+					node_name:    string(rune_name[inter_pos]),
+					next:         make([]*cache_node, 0),
+					rr:           nil,
+					intermediate: true,
+				}
+			}
+			// and add it to the current node's next list
+			cur_node.next = append(cur_node.next, found_node)
+		}
+		// then we need set the found or created node as cur_node for next it
+		cur_node = found_node
+		if found_node.intermediate {
+			inter_pos += 1
+			continue
+		}
+		// and pop one from the domain split
+		if len(domain_split) != 0 {
+			next_node_name = pop(&domain_split)
+			rune_name = []rune(next_node_name)
+			inter_pos = 0
+		} else {
+			break
+		}
+	}
+	return cur_node
+}
+
+// this gets the deepest node for a given domain
+// and a boolean to determine if this is the final answer
+func (cache *dns_cache) get_node(domain string) (node *cache_node, final bool) {
+	domain = strings.ToLower(domain)
+	// we get the node iteratively
+	domain_split := strings.Split(domain, ".")
+	next_node_name := pop(&domain_split)
+	rune_name := []rune(next_node_name)
+	cur_node := &cache.root
+	last_ns_node := &cache.root
+	inter_pos := 0
+	// okay hear me out: there is the possibility that a node that is deeper in the
+	// tree doesnt provide us with any useful information at all
+	// e.g. the following case
+	//                    .
+	//                  /   \
+	//                uy    org
+	//              /    \
+	//            com
+	//           /
+	//      random
+	// imagine we have received nameserver information for uy. but the domain we want to
+	// resolve is google.com.uy. -> without any further checking we would end up at
+	// com.uy. which doesnt help us, so we need to check each node for ns entries as well
+	for {
+		var found_node *cache_node = nil
+		for _, node := range cur_node.next {
+			if node.intermediate {
+				if inter_pos == len(rune_name) {
+					continue
+				}
+				if node.node_name == string(rune_name[inter_pos]) {
+					found_node = node
+					break
+				}
+			} else {
+				if node.node_name == next_node_name {
+					found_node = node
+					break
+				}
+			}
+		}
+		// if we couldnt find the node, we go home
+		if found_node == nil {
+			if cur_node.intermediate {
+				return last_ns_node, false
+			}
+			if len(cur_node.rr.nss) == 0 {
+				return last_ns_node, false
+			}
+			return cur_node, false
+		}
+		// otherwise we need set the found or created node as cur_node for next it
+		cur_node = found_node
+		if found_node.intermediate {
+			inter_pos += 1
+			continue
+		}
+		if len(found_node.rr.nss) != 0 {
+			last_ns_node = found_node
+		}
+		// and pop one from the domain split
+		if len(domain_split) != 0 {
+			next_node_name = pop(&domain_split)
+			rune_name = []rune(next_node_name)
+			inter_pos = 0
+		} else {
+			break
+		}
+	}
+	return cur_node, true
+}
+
+func (cache *dns_cache) update_ns(related_domain string, nameserver string) {
+	related_domain = strings.ToLower(related_domain)
+	nameserver = strings.ToLower(nameserver)
+	cache.mu.Lock()
+	cache.logger().Log(context.Background(), Level_trace, "updating cache", "domain", related_domain, "type", "NS", "value", nameserver)
+	to_update_node := cache.create_node(related_domain)
+	contains := false
+	// TODO emulate set by using smth like this instead: map[int]bool{1: true, 2: true}
+	for _, ns := range to_update_node.rr.nss {
+		if ns == nameserver {
+			contains = true
+			break
+		}
+	}
+	if !contains {
+		to_update_node.rr.nss = append(to_update_node.rr.nss, nameserver)
+	}
+	cache.mu.Unlock()
+}
+
+func (cache *dns_cache) update_a(domain string, ip net.IP) {
+	domain = strings.ToLower(domain)
+	cache.logger().Log(context.Background(), Level_trace, "updating cache", "domain", domain, "type", "A", "value", ip)
+	cache.mu.Lock()
+	to_update_node := cache.create_node(domain)
+	contains := false
+	for _, it_ip := range to_update_node.rr.ips {
+		if it_ip.String() == ip.String() {
+			contains = true
+			break
+		}
+	}
+	if !contains {
+		to_update_node.rr.ips = append(to_update_node.rr.ips, ip)
+	}
+	cache.mu.Unlock()
+}
+
+func (cache *dns_cache) update_cname(domain string, cname string) {
+	domain = strings.ToLower(domain)
+	cname = strings.ToLower(cname)
+	cache.mu.Lock()
+	to_update_node := cache.create_node(domain)
+	to_update_node.rr.cname = cname
+	cache.mu.Unlock()
+}
+
+func (cache *dns_cache) lookup(domain string) (ips []net.IP, nss []string, cname string, full_hit bool) {
+	domain = strings.ToLower(domain)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	last_node, final := cache.get_node(domain)
+	if final {
+		if last_node.rr.cname != "" {
+			return nil, nil, last_node.rr.cname, true
+		}
+		// copies, the nodes keep changing after the lock is released
+		ips = slices.Clone(last_node.rr.ips)
+	}
+	return ips, slices.Clone(last_node.rr.nss), "", final
+}
+
+func pop[T ~string | interface{}](a *[]T) T {
+	b := (*a)[len(*a)-1]
+	*a = (*a)[:len(*a)-1]
+	return b
+}
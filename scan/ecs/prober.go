@@ -0,0 +1,153 @@
+package ecs
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Result of an ECS query, Err is set if there was no answer
+type Result struct {
+	Domain          string
+	Nameserver      net.IP
+	Subnet          *net.IPNet // nil for a query without ECS option
+	Returned_subnet *net.IPNet // nil if the answer carried no ECS option
+	Scope           net.IPMask
+	Answers         []net.IP
+	Query_id        uint64
+	Sent_at         time.Time
+	Rtt             time.Duration // 0 if there was no answer
+	Source          net.IP        // local address the query was sent from, nil for the default
+	Baseline        bool          // one of the Baseline_subnets queries of a Scanner
+	Err             error
+}
+
+// ECSProber queries nameservers with an ECS option
+type ECSProber struct {
+	Transport     Transport
+	Sources       *Source_pool // local addresses the queries are sent from, nil for the default
+	Next_query_id func() uint64
+	Logger        *slog.Logger
+}
+
+func New_ecs_prober() *ECSProber {
+	return &ECSProber{
+		Transport:     &Udp_transport{Timeout: 5 * time.Second},
+		Next_query_id: default_next_query_id,
+	}
+}
+
+func (p *ECSProber) log() *slog.Logger {
+	if p.Logger == nil {
+		return discard_logger
+	}
+	return p.Logger
+}
+
+// Probe queries nsip for the A records of domain with subnet as client subnet, or
+// without any OPT record if subnet is nil
+func (p *ECSProber) Probe(ctx context.Context, domain string, nsip net.IP, subnet *net.IPNet) *Result {
+	result := &Result{
+		Domain:     domain,
+		Nameserver: nsip,
+		Subnet:     subnet,
+	}
+	if p.Next_query_id != nil {
+		result.Query_id = p.Next_query_id()
+	} else {
+		result.Query_id = default_next_query_id()
+	}
+	transport := p.Transport
+	if transport == nil {
+		transport = &Udp_transport{Timeout: 5 * time.Second}
+	}
+	p.log().Debug("ecs questioning", "server", nsip, "domain", domain, "subnet", subnet)
+	msg := New_ecs_msg(domain, dns.TypeA, subnet)
+
+	// Making the Query
+	result.Source = p.Sources.Next(nsip)
+	query_ctx := With_source(ctx, result.Source)
+	result.Sent_at = time.Now()
+	rec, rtt, err := transport.Exchange(query_ctx, msg, net.JoinHostPort(nsip.String(), "53"), result.Query_id)
+	if err != nil {
+		p.log().Error("ecs query failed", "server", nsip, "domain", domain, "subnet", subnet, "err", err)
+		result.Err = err
+		return result
+	}
+	result.Rtt = rtt
+	result.Answers = make([]net.IP, 0)
+	// Get the returned IP Addresses from the Query
+	if len(rec.Answer) != 0 {
+		for _, ans := range rec.Answer {
+			switch ans := ans.(type) {
+			case *dns.A:
+				result.Answers = append(result.Answers, net.IP(ans.A))
+			}
+		}
+		p.log().Log(ctx, Level_trace, "ecs found answers", "domain", domain, "subnet", subnet, "answers", result.Answers)
+	}
+	result.Returned_subnet, result.Scope = Get_ecs_opt(rec)
+	return result
+}
+
+// New_ecs_msg builds a query for domain carrying an ECS option with the given subnet
+// a nil subnet builds the query without any OPT record
+func New_ecs_msg(domain string, qtype uint16, subnet *net.IPNet) *dns.Msg {
+	// Build the message sent to the Auth Server
+	msg := dns.Msg{}
+	msg.Id = dns.Id()
+	msg.RecursionDesired = true
+	msg.Question = make([]dns.Question, 1)
+	msg.Question[0] = dns.Question{Name: domain + ".", Qtype: qtype, Qclass: dns.ClassINET}
+	if subnet == nil {
+		return &msg
+	}
+	msg.Extra = make([]dns.RR, 1)
+
+	// Creating OPT Record
+	opt := dns.OPT{}
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+
+	// Adding the EDNS0 Subnet Functionality
+	e := dns.EDNS0_SUBNET{}
+	e.Code = dns.EDNS0SUBNET
+	e.Family = 1 // 1 for IPv4 source address, 2 for IPv6
+	if subnet.IP.To4() == nil {
+		e.Family = 2
+	}
+	maskSize, _ := subnet.Mask.Size()
+	e.SourceNetmask = uint8(maskSize)
+	e.SourceScope = 0
+	e.Address = subnet.IP
+
+	opt.Option = append(opt.Option, &e)
+	msg.Extra[0] = &opt
+	return &msg
+}
+
+// Get_ecs_opt extracts the ECS option of a response, if there is any
+func Get_ecs_opt(rec *dns.Msg) (ecs_subnet *net.IPNet, ecs_scope net.IPMask) {
+	for _, rr := range rec.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			// Iterate over the EDNS0 options
+			for _, opt := range opt.Option {
+				if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+					// ECS information found
+					bits := 32
+					if ecs.Family == 2 {
+						bits = 128
+					}
+					mask := net.CIDRMask(int(ecs.SourceNetmask), bits)
+					ecs_subnet = &net.IPNet{IP: ecs.Address, Mask: mask}
+					ecs_scope = net.CIDRMask(int(ecs.SourceScope), bits)
+					return ecs_subnet, ecs_scope
+				}
+			}
+		}
+	}
+	return nil, nil
+}
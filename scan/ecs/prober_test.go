@@ -0,0 +1,101 @@
+package ecs
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		subnet string // empty for a query without ecs
+		// the ecs option of the answer, nil for none
+		returned *dns.EDNS0_SUBNET
+		want     string // returned subnet
+		scope    int
+	}{
+		{
+			name:     "v4",
+			subnet:   "203.0.113.0/24",
+			returned: &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 20, Address: net.ParseIP("203.0.113.0").To4()},
+			want:     "203.0.113.0/24",
+			scope:    20,
+		},
+		{
+			name:     "v4 scope zero",
+			subnet:   "203.0.113.0/24",
+			returned: &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 0, Address: net.ParseIP("203.0.113.0").To4()},
+			want:     "203.0.113.0/24",
+			scope:    0,
+		},
+		{
+			name:     "v6",
+			subnet:   "2001:db8:1::/48",
+			returned: &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 48, SourceScope: 56, Address: net.ParseIP("2001:db8:1::")},
+			want:     "2001:db8:1::/48",
+			scope:    56,
+		},
+		{
+			name:   "no ecs in the answer",
+			subnet: "203.0.113.0/24",
+		},
+		{
+			name: "baseline without ecs",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var subnet *net.IPNet = nil
+			if test.subnet != "" {
+				_, subnet, _ = net.ParseCIDR(test.subnet)
+			}
+			var sent *dns.Msg = nil
+			p := New_ecs_prober()
+			p.Transport = Exchange_func(func(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+				sent = msg
+				rec := new(dns.Msg)
+				rec.SetReply(msg)
+				rec.Answer = must_rrs(t, []string{"www.example.com. 300 IN A 198.51.100.10"})
+				if test.returned != nil {
+					rec.SetEdns0(dns.DefaultMsgSize, false)
+					rec.IsEdns0().Option = append(rec.IsEdns0().Option, test.returned)
+				}
+				return rec, 3 * time.Millisecond, nil
+			})
+			result := p.Probe(context.Background(), "www.example.com", net.ParseIP("192.0.2.3"), subnet)
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			if subnet == nil && sent.IsEdns0() != nil {
+				t.Error("baseline query sent with an OPT record")
+			}
+			if subnet != nil {
+				returned_subnet, _ := Get_ecs_opt(sent)
+				if returned_subnet.String() != subnet.String() {
+					t.Errorf("query sent with subnet %s, want %s", returned_subnet, subnet)
+				}
+			}
+			if len(result.Answers) != 1 || !result.Answers[0].Equal(net.ParseIP("198.51.100.10")) || result.Rtt != 3*time.Millisecond {
+				t.Errorf("answers = %v, rtt = %s", result.Answers, result.Rtt)
+			}
+			if test.returned == nil {
+				if result.Returned_subnet != nil || result.Scope != nil {
+					t.Errorf("returned subnet = %s, scope = %s, want none", result.Returned_subnet, result.Scope)
+				}
+				return
+			}
+			if result.Returned_subnet.String() != test.want {
+				t.Errorf("returned subnet = %s, want %s", result.Returned_subnet, test.want)
+			}
+			scope, bits := result.Scope.Size()
+			_, want_bits := result.Returned_subnet.Mask.Size()
+			if scope != test.scope || bits != want_bits {
+				t.Errorf("scope = /%d of %d bits, want /%d of %d", scope, bits, test.scope, want_bits)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+// Package ecs measures how authoritative nameservers answer EDNS Client Subnet queries.
+//
+// A Resolver iteratively resolves domains from the root, caching the delegations in
+// a tree, and reports the nameserver that gave the final answer. An ECSProber queries
+// such a nameserver with an ECS option and records the returned subnet, scope and
+// answers. A Scanner runs both over lists of domains and subnets with worker pools.
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Level_trace is below debug, for the very chatty cache updates
+const Level_trace = slog.LevelDebug - 4
+
+// Root_server is the default root server of a Resolver
+// RIPE NCC "k.root-servers.net" as we are in europe, see https://www.iana.org/domains/root/servers
+var Root_server net.IP = net.ParseIP("193.0.14.129")
+
+// used if no Next_query_id is given
+var default_query_id atomic.Uint64
+
+func default_next_query_id() uint64 {
+	return default_query_id.Add(1)
+}
+
+var discard_logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Resolver is an iterative resolver starting at Root
+// all fields can be changed until the first call of Resolve
+type Resolver struct {
+	Root          net.IP
+	Blocklist     []*net.IPNet // servers in these networks are never queried
+	Max_depth     int          // of the resolution path, including cnames and nameserver lookups
+	Transport     Transport
+	Sources       *Source_pool // local addresses the queries are sent from, nil for the default
+	Next_query_id func() uint64
+	Logger        *slog.Logger
+	Trace         io.Writer // if set, every step of the resolution is written to it
+	cache         *dns_cache
+}
+
+// New_resolver returns a Resolver with an empty cache
+// intermediate_depth is the number of single character nodes per label in the cache tree
+func New_resolver(intermediate_depth int) *Resolver {
+	r := &Resolver{
+		Root:          Root_server,
+		Blocklist:     []*net.IPNet{},
+		Max_depth:     50,
+		Transport:     &Udp_transport{Timeout: 5 * time.Second},
+		Next_query_id: default_next_query_id,
+	}
+	r.cache = new_dns_cache(intermediate_depth, r.log)
+	return r
+}
+
+func (r *Resolver) log() *slog.Logger {
+	if r.Logger == nil {
+		return discard_logger
+	}
+	return r.Logger
+}
+
+func (r *Resolver) transport() Transport {
+	if r.Transport == nil {
+		return &Udp_transport{Timeout: 5 * time.Second}
+	}
+	return r.Transport
+}
+
+func (r *Resolver) next_query_id() uint64 {
+	if r.Next_query_id == nil {
+		return default_next_query_id()
+	}
+	return r.Next_query_id()
+}
+
+func (r *Resolver) trace(depth int, v ...any) {
+	if r.Trace == nil {
+		return
+	}
+	fmt.Fprint(r.Trace, strings.Repeat("  ", depth)+fmt.Sprintln(v...))
+}
+
+func (r *Resolver) on_blocklist(server net.IP) bool {
+	for _, blocked_net := range r.Blocklist {
+		if blocked_net.Contains(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush_cache forgets everything learned so far
+func (r *Resolver) Flush_cache() {
+	r.cache.flush()
+}
+
+// Walk_cache calls fn for every node of the cache tree in preorder
+func (r *Resolver) Walk_cache(fn func(level int, name string, nss []string, ips []net.IP, intermediate bool)) {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	r.cache.root.preorder(0, fn)
+}
+
+// Resolve returns the answers for domain, the nameserver that gave them and the rtt
+// of that last query (0 if the answers came from the cache)
+func (r *Resolver) Resolve(ctx context.Context, domain string) (answers []net.IP, nameserver net.IP, rtt time.Duration) {
+	return r.resolve(ctx, domain, []string{})
+}
+
+func (r *Resolver) resolve(ctx context.Context, domain string, path []string) (answers []net.IP, nameserver net.IP, rtt time.Duration) {
+	domain = strings.ToLower(domain)
+	path = append(path, domain)
+	depth := len(path) - 1
+	r.trace(depth, "resolving", domain)
+	if len(path) > r.Max_depth {
+		r.log().Warn("maximum depth exceeded", "domain", domain)
+		return nil, nil, 0
+	}
+	if err := ctx.Err(); err != nil {
+		r.trace(depth, "giving up:", err)
+		return nil, nil, 0
+	}
+
+	server := r.Root
+
+	// === cache lookup ===
+	// before we do anything we check the cache
+	cache_ips, cache_nss, cache_cname, definitive := r.cache.lookup(domain)
+	// its storytime again; cases like these exist:
+	// dig @193.0.9.84 NS1.NULL1.kg A
+	// ;; AUTH
+	//   NULL1.KG.		86400	IN	NS	NS2.NULL1.KG.
+	//   NULL1.KG.		86400	IN	NS	NS1.NULL1.KG.
+	// ;; ADDITIONAL
+	//   n/a
+	// 193.0.9.84 (kg.cctld.authdns.ripe.net.) is the toplvl ns responsible for kg.
+	// what does this tell us? ダメだーー！
+	if slices.Contains(cache_nss, domain) {
+		r.trace(depth, "domain is its own nameserver, giving up")
+		return nil, nil, 0
+	}
+	// should the domain be cnamed we just go from there
+	if cache_cname != "" {
+		r.log().Debug("cached cname found", "domain", domain, "target", cache_cname)
+		r.trace(depth, "cache: cname", domain, "->", cache_cname)
+		return r.resolve(ctx, cache_cname, path)
+	}
+	// otherwise we question the cache if we know one of the ips of the provided nameservers
+	// theoretically we could call resolve again here with one randomly chosen nameserver,
+	// but then we wouldnt know for which one we would hold the information in cache and just take a random
+	// guess at it; i thought it to be best to use the one we have instead of potentially querying for one we dont
+	var cache_ns_ips []net.IP
+	// TODO shuffle cache_nss??
+	for _, cache_ns := range cache_nss {
+		// TODO i wonder if this should better be a resolve(cache_only=true),
+		// because what if the nameserver is cnamed?
+		tmp_cache_ns_ips, _, _, _ := r.cache.lookup(cache_ns)
+		if len(tmp_cache_ns_ips) != 0 {
+			// as soon as we hit, we break and use that one for any further requests (or returns)
+			cache_ns_ips = tmp_cache_ns_ips
+			break
+		}
+	}
+	// if we have answer ips we return those, and potentially the ns ip
+	if len(cache_ips) != 0 {
+		r.trace(depth, "cache: answers", cache_ips)
+		if len(cache_ns_ips) != 0 {
+			return cache_ips, cache_ns_ips[rand.Intn(len(cache_ns_ips))], 0
+		} else {
+			return cache_ips, nil, 0
+		}
+	} else if len(cache_ns_ips) != 0 {
+		server = cache_ns_ips[rand.Intn(len(cache_ns_ips))]
+		r.trace(depth, "cache: nameservers", cache_nss, "using", server)
+	} else if len(cache_nss) != 0 {
+		// in case we dont, we need to query the domain and therefore we need the resolved ns
+		ns := cache_nss[rand.Intn(len(cache_nss))]
+		r.trace(depth, "cache: nameservers", cache_nss, "without address, resolving", ns)
+		ns_ips, _, _ := r.resolve(ctx, ns, path)
+		if len(ns_ips) != 0 {
+			// we now know the ns ip but not the domain ip
+			server = ns_ips[rand.Intn(len(ns_ips))]
+		} else {
+			// at this point for whatever reason the cached nameserver is not existent
+			r.log().Debug("no ip for cached ns found", "ns", ns)
+			return nil, nil, 0
+		}
+	}
+	if r.on_blocklist(server) {
+		r.trace(depth, "server", server, "is on the blocklist")
+		return nil, nil, 0
+	}
+
+	// === make & send the actual dns query ===
+	msg := dns.Msg{}
+	msg.SetQuestion(domain+".", dns.TypeA)
+	r.log().Debug("questioning", "server", server, "qname", msg.Question[0].Name)
+	r.trace(depth, "query", msg.Question[0].Name, "A @"+server.String())
+	query_ctx := With_source(ctx, r.Sources.Next(server))
+	rec, rtt, err := r.transport().Exchange(query_ctx, &msg, net.JoinHostPort(server.String(), "53"), r.next_query_id())
+	if err != nil {
+		r.log().Error("query failed", "domain", domain, "server", server, "err", err)
+		r.trace(depth, "error:", err)
+	}
+
+	// === handle the response ===
+	if rec == nil {
+		r.log().Warn("answer is nil", "domain", domain, "server", server)
+		return nil, nil, 0
+	}
+	r.trace(depth, "response", dns.RcodeToString[rec.Rcode], "in", rtt, "answer:", len(rec.Answer), "authority:", len(rec.Ns), "additional:", len(rec.Extra))
+	if len(rec.Answer) != 0 {
+		var answers []net.IP
+		var cname string = ""
+		for _, ans := range rec.Answer {
+			switch ans := ans.(type) {
+			case *dns.A:
+				answers = append(answers, ans.A)
+				if path[0] != domain { // dont need to cache the original domain, as it is only looked up once
+					r.cache.update_a(domain, ans.A)
+				}
+			case *dns.CNAME:
+				r.log().Debug("found cname", "domain", domain, "target", ans.Target)
+				r.trace(depth, "cname", domain, "->", ans.Target)
+				cname = ans.Target[:len(ans.Target)-1]
+				if path[0] != domain {
+					r.cache.update_cname(domain, cname)
+				}
+			}
+		}
+		// no ip answers -> check the cname
+		if len(answers) == 0 && cname != "" {
+			return r.resolve(ctx, cname, path)
+		}
+		r.log().Debug("resolve found answers", "domain", domain, "answers", answers)
+		r.trace(depth, "answers", answers, "from", server)
+		return answers, server, rtt
+	} else if definitive {
+		// return empty-handed (◡︵◡)
+		return nil, nil, 0
+	}
+	r.log().Debug("no direct answers found", "domain", domain)
+
+	if len(rec.Ns) == 0 {
+		r.log().Warn("no nameservers found", "domain", domain)
+		return nil, nil, 0
+	}
+
+	var new_ns_names []string
+	var related_domain string // assuming all the responses are for the same domain
+	for _, ans := range rec.Ns {
+		switch ans := ans.(type) {
+		case *dns.NS:
+			related_domain = ans.Hdr.Name[:len(ans.Hdr.Name)-1] //remove trailing dot, as it's appended again by miekg/dns
+			ns_name := ans.Ns[:len(ans.Ns)-1]
+			new_ns_names = append(new_ns_names, ns_name)
+			// update cache tree
+			r.cache.update_ns(related_domain, ns_name)
+		}
+	}
+	/*for _, alr_domain := range path {
+		if slices.Contains(new_ns_names, alr_domain) {
+			r.log().Warn("path already contains nameserver", "domain", alr_domain)
+			return nil, nil, 0
+		}
+	}*/
+	r.log().Debug("found next possible nameservers", "nameservers", new_ns_names, "related_domain", related_domain)
+	r.trace(depth, "referral to", new_ns_names, "for", related_domain)
+
+	// if there is data in the additional section we take those
+	// (as the nameservers are already resolved)
+	if len(rec.Extra) != 0 {
+		// list for all the possibly new nameservers
+		// so that we can choose one randomly later on
+		var new_ns_ips []net.IP
+		for _, ans := range rec.Extra {
+			switch ans := ans.(type) {
+			case *dns.A:
+				related_domain := ans.Hdr.Name[:len(ans.Hdr.Name)-1]
+				r.cache.update_a(related_domain, ans.A)
+				new_ns_ips = append(new_ns_ips, ans.A)
+			}
+		}
+		r.log().Debug("found next nameserver ips", "ips", new_ns_ips)
+		r.trace(depth, "glue", new_ns_ips)
+	}
+
+	if len(new_ns_names) != 0 {
+		return r.resolve(ctx, domain, path)
+	}
+	return nil, nil, 0
+}
@@ -0,0 +1,203 @@
+package ecs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// the sections of an answer, as zone file lines
+type scripted_response struct {
+	answer []string
+	ns     []string
+	extra  []string
+}
+
+// server ip -> qname -> response, every other query is refused
+type script map[string]map[string]scripted_response
+
+func must_rrs(t *testing.T, lines []string) []dns.RR {
+	t.Helper()
+	rrs := make([]dns.RR, 0, len(lines))
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// a transport answering from s, the queries it got are appended to queries as
+// "server qname"
+func scripted_transport(t *testing.T, s script, queries *[]string) Transport {
+	return Exchange_func(func(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil || port != "53" {
+			t.Errorf("query sent to %q", server)
+		}
+		qname := msg.Question[0].Name
+		*queries = append(*queries, host+" "+qname)
+		response, ok := s[host][qname]
+		if !ok {
+			return nil, 0, errors.New("refused")
+		}
+		rec := new(dns.Msg)
+		rec.SetReply(msg)
+		rec.Answer = must_rrs(t, response.answer)
+		rec.Ns = must_rrs(t, response.ns)
+		rec.Extra = must_rrs(t, response.extra)
+		return rec, 7 * time.Millisecond, nil
+	})
+}
+
+// root 192.0.2.1, com. and net. on 192.0.2.2, example.com. on 192.0.2.3 and
+// example.net. on 192.0.2.4
+func test_script() script {
+	com_referral := scripted_response{
+		ns:    []string{"com. 172800 IN NS a.gtld.test."},
+		extra: []string{"a.gtld.test. 172800 IN A 192.0.2.2"},
+	}
+	net_referral := scripted_response{
+		ns:    []string{"net. 172800 IN NS a.gtld.test."},
+		extra: []string{"a.gtld.test. 172800 IN A 192.0.2.2"},
+	}
+	example_com_referral := scripted_response{
+		ns:    []string{"example.com. 172800 IN NS ns1.example.com."},
+		extra: []string{"ns1.example.com. 172800 IN A 192.0.2.3"},
+	}
+	example_net_referral := scripted_response{
+		ns:    []string{"example.net. 172800 IN NS ns1.example.net."},
+		extra: []string{"ns1.example.net. 172800 IN A 192.0.2.4"},
+	}
+	return script{
+		"192.0.2.1": {
+			"www.example.com.":  com_referral,
+			"cdn.example.com.":  com_referral,
+			"edge.example.net.": net_referral,
+		},
+		"192.0.2.2": {
+			"www.example.com.":  example_com_referral,
+			"cdn.example.com.":  example_com_referral,
+			"edge.example.net.": example_net_referral,
+		},
+		"192.0.2.3": {
+			"www.example.com.": {answer: []string{"www.example.com. 300 IN A 198.51.100.10", "www.example.com. 300 IN A 198.51.100.11"}},
+			"cdn.example.com.": {answer: []string{"cdn.example.com. 300 IN CNAME web.example.com."}},
+			"web.example.com.": {answer: []string{"web.example.com. 300 IN CNAME edge.example.net."}},
+		},
+		"192.0.2.4": {
+			"edge.example.net.": {answer: []string{"edge.example.net. 300 IN A 203.0.113.7"}},
+		},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		domain     string
+		blocklist  []string
+		answers    []string
+		nameserver string // empty if the resolution fails
+		queries    []string
+	}{
+		{
+			name:       "referral, glue, answer",
+			domain:     "www.example.com",
+			answers:    []string{"198.51.100.10", "198.51.100.11"},
+			nameserver: "192.0.2.3",
+			queries:    []string{"192.0.2.1 www.example.com.", "192.0.2.2 www.example.com.", "192.0.2.3 www.example.com."},
+		},
+		{
+			name:       "cname chain",
+			domain:     "cdn.example.com",
+			answers:    []string{"203.0.113.7"},
+			nameserver: "192.0.2.4",
+			queries: []string{
+				"192.0.2.1 cdn.example.com.", "192.0.2.2 cdn.example.com.", "192.0.2.3 cdn.example.com.",
+				// example.com. is cached, example.net. is not
+				"192.0.2.3 web.example.com.",
+				"192.0.2.1 edge.example.net.", "192.0.2.2 edge.example.net.", "192.0.2.4 edge.example.net.",
+			},
+		},
+		{
+			name:      "blocklisted nameserver",
+			domain:    "www.example.com",
+			blocklist: []string{"192.0.2.3/32"},
+			queries:   []string{"192.0.2.1 www.example.com.", "192.0.2.2 www.example.com."},
+		},
+		{
+			name:      "blocklisted root",
+			domain:    "www.example.com",
+			blocklist: []string{"192.0.2.0/24"},
+			queries:   []string{},
+		},
+		{
+			name:    "refused",
+			domain:  "www.example.org",
+			queries: []string{"192.0.2.1 www.example.org."},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queries := []string{}
+			r := New_resolver(0)
+			r.Root = net.ParseIP("192.0.2.1")
+			r.Transport = scripted_transport(t, test_script(), &queries)
+			for _, cidr := range test.blocklist {
+				_, blocked_net, _ := net.ParseCIDR(cidr)
+				r.Blocklist = append(r.Blocklist, blocked_net)
+			}
+			answers, nameserver, rtt := r.Resolve(context.Background(), test.domain)
+
+			got := make([]string, 0, len(answers))
+			for _, ip := range answers {
+				got = append(got, ip.String())
+			}
+			if !slices.Equal(got, test.answers) {
+				t.Errorf("answers = %v, want %v", got, test.answers)
+			}
+			if test.nameserver == "" {
+				if nameserver != nil || rtt != 0 {
+					t.Errorf("nameserver = %s, rtt = %s, want none", nameserver, rtt)
+				}
+			} else {
+				if !nameserver.Equal(net.ParseIP(test.nameserver)) {
+					t.Errorf("nameserver = %s, want %s", nameserver, test.nameserver)
+				}
+				if rtt != 7*time.Millisecond {
+					t.Errorf("rtt = %s, want 7ms", rtt)
+				}
+			}
+			if !slices.Equal(queries, test.queries) {
+				t.Errorf("queries:\n got %q\nwant %q", queries, test.queries)
+			}
+		})
+	}
+}
+
+// the delegation to example.com. is cached, the second name of the zone is asked
+// directly
+func TestResolveCached(t *testing.T) {
+	queries := []string{}
+	s := test_script()
+	s["192.0.2.3"]["mail.example.com."] = scripted_response{answer: []string{"mail.example.com. 300 IN A 198.51.100.25"}}
+	r := New_resolver(0)
+	r.Root = net.ParseIP("192.0.2.1")
+	r.Transport = scripted_transport(t, s, &queries)
+	r.Resolve(context.Background(), "www.example.com")
+	queries = queries[:0]
+	answers, nameserver, _ := r.Resolve(context.Background(), "mail.example.com")
+	if len(answers) != 1 || !answers[0].Equal(net.ParseIP("198.51.100.25")) || !nameserver.Equal(net.ParseIP("192.0.2.3")) {
+		t.Errorf("answers = %v from %s", answers, nameserver)
+	}
+	if want := []string{"192.0.2.3 mail.example.com."}; !slices.Equal(queries, want) {
+		t.Errorf("queries = %q, want %q", queries, want)
+	}
+}
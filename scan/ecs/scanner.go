@@ -0,0 +1,298 @@
+package ecs
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Nameserver is a domain with the nameserver that answered for it
+// Ip stays nil if the domain could not be resolved
+type Nameserver struct {
+	Domain           string
+	Ip               net.IP
+	Resolve_duration time.Duration // how long the whole resolution took
+	Rtt              time.Duration // rtt of the final query to Ip, 0 if cached
+}
+
+// Baseline_subnets are the reference queries of Scanner.Baseline: one without any
+// OPT record (nil) and one with ECS 0.0.0.0/0, which asks for the answer that is not
+// tailored to any client
+var Baseline_subnets = []*net.IPNet{nil, {IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}}
+
+// Scanner resolves the nameservers of domains and queries them with subnets, both
+// with a pool of workers
+// results are handed to the callbacks, which are called from the workers concurrently
+type Scanner struct {
+	resolver        *Resolver
+	prober          *ECSProber
+	ns_workers      int
+	ecs_workers     int
+	resolve_timeout time.Duration
+	repeats         int
+	repeat_spacing  time.Duration
+	scheduler       Scheduler
+	on_nameserver   func(ns *Nameserver)
+	on_result       func(result *Result)
+	on_stability    func(stability *Stability)
+	on_subnet_start func(index int, subnet *net.IPNet)
+	on_subnet_done  func(index int, subnet *net.IPNet)
+
+	pending_mu sync.Mutex
+	pending    func() int // length of the queue of the running pool
+}
+
+type Option func(s *Scanner)
+
+func With_resolver(resolver *Resolver) Option {
+	return func(s *Scanner) { s.resolver = resolver }
+}
+
+func With_prober(prober *ECSProber) Option {
+	return func(s *Scanner) { s.prober = prober }
+}
+
+// number of concurrent resolutions
+func With_ns_workers(n int) Option {
+	return func(s *Scanner) { s.ns_workers = n }
+}
+
+// number of concurrent ecs queries
+func With_ecs_workers(n int) Option {
+	return func(s *Scanner) { s.ecs_workers = n }
+}
+
+// limits the resolution of a single domain, 0 for no limit
+func With_resolve_timeout(timeout time.Duration) Option {
+	return func(s *Scanner) { s.resolve_timeout = timeout }
+}
+
+// asks every question n times, spacing apart, and hands a Stability of the answers to
+// On_stability; the worker is busy for the whole time, so spacing slows down the scan
+func With_repeats(n int, spacing time.Duration) Option {
+	return func(s *Scanner) {
+		s.repeats = n
+		s.repeat_spacing = spacing
+	}
+}
+
+// sets the order in which Scan asks the questions, By_subnet by default
+func With_scheduler(scheduler Scheduler) Option {
+	return func(s *Scanner) { s.scheduler = scheduler }
+}
+
+// called for every domain once its resolution is over, resolved or not
+func On_nameserver(fn func(ns *Nameserver)) Option {
+	return func(s *Scanner) { s.on_nameserver = fn }
+}
+
+// called for every ecs query
+func On_result(fn func(result *Result)) Option {
+	return func(s *Scanner) { s.on_result = fn }
+}
+
+// called with the summary of the repeated queries of a question, only with repeats > 1
+func On_stability(fn func(stability *Stability)) Option {
+	return func(s *Scanner) { s.on_stability = fn }
+}
+
+// called before a subnet is scanned
+func On_subnet_start(fn func(index int, subnet *net.IPNet)) Option {
+	return func(s *Scanner) { s.on_subnet_start = fn }
+}
+
+// called once a subnet was scanned with all nameservers, not if the scan was cancelled
+func On_subnet_done(fn func(index int, subnet *net.IPNet)) Option {
+	return func(s *Scanner) { s.on_subnet_done = fn }
+}
+
+func New_scanner(opts ...Option) *Scanner {
+	s := &Scanner{
+		ns_workers:      50,
+		ecs_workers:     100,
+		repeats:         1,
+		scheduler:       By_subnet{},
+		pending:         func() int { return 0 },
+		on_nameserver:   func(*Nameserver) {},
+		on_result:       func(*Result) {},
+		on_stability:    func(*Stability) {},
+		on_subnet_start: func(int, *net.IPNet) {},
+		on_subnet_done:  func(int, *net.IPNet) {},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.resolver == nil {
+		s.resolver = New_resolver(0)
+	}
+	if s.prober == nil {
+		s.prober = New_ecs_prober()
+	}
+	return s
+}
+
+func (s *Scanner) Resolver() *Resolver {
+	return s.resolver
+}
+
+// Pending returns the number of nameservers (or batches of jobs) waiting for a worker
+func (s *Scanner) Pending() int {
+	s.pending_mu.Lock()
+	defer s.pending_mu.Unlock()
+	return s.pending()
+}
+
+func (s *Scanner) set_pending(pending func() int) {
+	s.pending_mu.Lock()
+	s.pending = pending
+	s.pending_mu.Unlock()
+}
+
+// hands the targets in random order to n workers running work
+// returns once all handed out targets are done, or ctx is
+func (s *Scanner) run_pool(ctx context.Context, targets []*Nameserver, n int, skip func(*Nameserver) bool, work func(*Nameserver)) {
+	queue := make(chan *Nameserver, 256)
+	s.set_pending(func() int { return len(queue) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range queue {
+				// the rest of the queue is dropped once cancelled
+				if ctx.Err() != nil {
+					continue
+				}
+				work(target)
+			}
+		}()
+	}
+	order := slices.Clone(targets)
+	rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+feed:
+	for _, target := range order {
+		if skip(target) {
+			continue
+		}
+		select {
+		case queue <- target:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// Resolve_nameservers fills in the nameserver of every target
+func (s *Scanner) Resolve_nameservers(ctx context.Context, targets []*Nameserver) {
+	skip := func(*Nameserver) bool { return false }
+	s.run_pool(ctx, targets, s.ns_workers, skip, func(target *Nameserver) {
+		domain_ctx, cancel := ctx, context.CancelFunc(func() {})
+		if s.resolve_timeout > 0 {
+			domain_ctx, cancel = context.WithTimeout(ctx, s.resolve_timeout)
+		}
+		t_start := time.Now()
+		answers, used_server, rtt := s.resolver.Resolve(domain_ctx, target.Domain)
+		cancel()
+		s.resolver.log().Debug("resolved", "domain", target.Domain, "answers", answers, "server", used_server, "took", time.Since(t_start))
+		if len(answers) != 0 {
+			target.Ip = used_server
+			target.Resolve_duration = time.Since(t_start)
+			target.Rtt = rtt
+		}
+		s.on_nameserver(target)
+	})
+}
+
+// queries target with subnet repeats times and hands every result to On_result
+func (s *Scanner) probe(ctx context.Context, target *Nameserver, subnet *net.IPNet, baseline bool) {
+	results := make([]*Result, 0, s.repeats)
+	for i := 0; i < s.repeats; i++ {
+		if i != 0 {
+			select {
+			case <-time.After(s.repeat_spacing):
+			case <-ctx.Done():
+				return
+			}
+		}
+		result := s.prober.Probe(ctx, target.Domain, target.Ip, subnet)
+		result.Baseline = baseline
+		s.on_result(result)
+		results = append(results, result)
+	}
+	if s.repeats > 1 {
+		s.on_stability(New_stability(results))
+	}
+}
+
+// Baseline queries every resolved target with each of Baseline_subnets, the results
+// are handed to On_result with Baseline set
+func (s *Scanner) Baseline(ctx context.Context, targets []*Nameserver) {
+	skip := func(target *Nameserver) bool { return target.Ip == nil }
+	s.run_pool(ctx, targets, s.ecs_workers, skip, func(target *Nameserver) {
+		for _, subnet := range Baseline_subnets {
+			s.probe(ctx, target, subnet, true)
+		}
+	})
+}
+
+// Scan queries every resolved target with every subnet, in the order of the scheduler
+// a subnet is started with its first job and done once all its jobs are
+func (s *Scanner) Scan(ctx context.Context, targets []*Nameserver, subnets []*net.IPNet) {
+	resolved := make([]*Nameserver, 0, len(targets))
+	for _, target := range targets {
+		if target.Ip != nil {
+			resolved = append(resolved, target)
+		}
+	}
+	started := make([]atomic.Bool, len(subnets))
+	remaining := make([]atomic.Int64, len(subnets))
+	for i, subnet := range subnets {
+		remaining[i].Store(int64(len(resolved)))
+		if len(resolved) == 0 && ctx.Err() == nil {
+			s.on_subnet_start(i, subnet)
+			s.on_subnet_done(i, subnet)
+		}
+	}
+
+	queue := make(chan []*Job, 256)
+	s.set_pending(func() int { return len(queue) })
+	var wg sync.WaitGroup
+	for i := 0; i < s.ecs_workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				for _, job := range batch {
+					// the rest of the queue is dropped once cancelled
+					if ctx.Err() != nil {
+						break
+					}
+					if started[job.Subnet_index].CompareAndSwap(false, true) {
+						s.on_subnet_start(job.Subnet_index, job.Subnet)
+					}
+					s.probe(ctx, job.Target, job.Subnet, false)
+					if remaining[job.Subnet_index].Add(-1) == 0 && ctx.Err() == nil {
+						s.on_subnet_done(job.Subnet_index, job.Subnet)
+					}
+				}
+			}
+		}()
+	}
+	s.scheduler.Schedule(ctx, resolved, subnets, func(batch []*Job) bool {
+		select {
+		case queue <- batch:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,124 @@
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+)
+
+// scheduling
+// a Scheduler decides in which order the questions of a scan are asked. it hands
+// batches of jobs to the workers, every batch is asked back to back by a single worker
+
+// Job is the question of one subnet to one nameserver
+type Job struct {
+	Target       *Nameserver
+	Subnet_index int
+	Subnet       *net.IPNet
+}
+
+// Scheduler passes every (target, subnet) of a scan exactly once to emit
+// it stops as soon as emit returns false, i.e. once the scan is cancelled
+type Scheduler interface {
+	Schedule(ctx context.Context, targets []*Nameserver, subnets []*net.IPNet, emit func(batch []*Job) bool)
+}
+
+// names accepted by New_scheduler
+var Scheduler_names = []string{"subnet", "domain", "random"}
+
+func New_scheduler(name string) (Scheduler, error) {
+	switch name {
+	case "subnet":
+		return By_subnet{}, nil
+	case "domain":
+		return By_domain{}, nil
+	case "random":
+		return Randomized{}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler %q", name)
+}
+
+func shuffled[T any](a []T) []T {
+	b := slices.Clone(a)
+	rand.Shuffle(len(b), func(i, j int) { b[i], b[j] = b[j], b[i] })
+	return b
+}
+
+// By_subnet asks all targets (in random order) with the first subnet, then all with
+// the second and so on; the answers for one domain are a whole round apart
+type By_subnet struct{}
+
+func (By_subnet) Schedule(ctx context.Context, targets []*Nameserver, subnets []*net.IPNet, emit func(batch []*Job) bool) {
+	for i, subnet := range subnets {
+		for _, target := range shuffled(targets) {
+			if !emit([]*Job{{Target: target, Subnet_index: i, Subnet: subnet}}) {
+				return
+			}
+		}
+	}
+}
+
+// By_domain asks every target (in random order) with all subnets back to back, so the
+// answers for one domain are only seconds apart
+type By_domain struct{}
+
+func (By_domain) Schedule(ctx context.Context, targets []*Nameserver, subnets []*net.IPNet, emit func(batch []*Job) bool) {
+	if len(subnets) == 0 {
+		return
+	}
+	for _, target := range shuffled(targets) {
+		batch := make([]*Job, 0, len(subnets))
+		for i, subnet := range subnets {
+			batch = append(batch, &Job{Target: target, Subnet_index: i, Subnet: subnet})
+		}
+		if !emit(batch) {
+			return
+		}
+	}
+}
+
+// Randomized asks all (target, subnet) pairs in one random order, spreading both the
+// load on every nameserver and the answer changes over time evenly
+// the pairs are not materialized: the shuffled targets and subnets are walked with an
+// affine permutation i -> (a*i + b) mod n
+type Randomized struct{}
+
+func gcd(a uint64, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func (Randomized) Schedule(ctx context.Context, targets []*Nameserver, subnets []*net.IPNet, emit func(batch []*Job) bool) {
+	n := uint64(len(targets)) * uint64(len(subnets))
+	if n == 0 {
+		return
+	}
+	order_targets := shuffled(targets)
+	order_subnets := make([]int, len(subnets))
+	for i := range order_subnets {
+		order_subnets[i] = i
+	}
+	order_subnets = shuffled(order_subnets)
+	a := uint64(1)
+	if n > 2 {
+		for {
+			a = 1 + rand.Uint64()%(n-1)
+			if gcd(a, n) == 1 {
+				break
+			}
+		}
+	}
+	// (a*i + b) mod n, built up step by step as a*i might overflow
+	j := rand.Uint64() % n
+	for i := uint64(0); i < n; i, j = i+1, (j+a)%n {
+		target := order_targets[j/uint64(len(subnets))]
+		subnet_index := order_subnets[j%uint64(len(subnets))]
+		if !emit([]*Job{{Target: target, Subnet_index: subnet_index, Subnet: subnets[subnet_index]}}) {
+			return
+		}
+	}
+}
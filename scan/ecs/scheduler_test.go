@@ -0,0 +1,111 @@
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func test_targets(n int) []*Nameserver {
+	targets := make([]*Nameserver, 0, n)
+	for i := 0; i < n; i++ {
+		targets = append(targets, &Nameserver{Domain: fmt.Sprintf("d%d.test", i), Ip: net.IPv4(192, 0, 2, byte(i))})
+	}
+	return targets
+}
+
+func test_subnets(n int) []*net.IPNet {
+	subnets := make([]*net.IPNet, 0, n)
+	for i := 0; i < n; i++ {
+		subnets = append(subnets, &net.IPNet{IP: net.IPv4(10, byte(i>>8), byte(i), 0).To4(), Mask: net.CIDRMask(24, 32)})
+	}
+	return subnets
+}
+
+// the sizes as (targets, subnets): empty, single, primes, coprime and not coprime
+var schedule_sizes = [][2]int{
+	{0, 5}, {5, 0}, {1, 1}, {1, 2}, {2, 1}, {2, 2}, {3, 1}, {1, 7},
+	{7, 13}, {13, 7}, {4, 6}, {6, 4}, {8, 8}, {9, 15}, {12, 18}, {31, 1}, {16, 32},
+}
+
+func TestSchedulers(t *testing.T) {
+	schedulers := map[string]Scheduler{"subnet": By_subnet{}, "domain": By_domain{}, "random": Randomized{}}
+	for name, scheduler := range schedulers {
+		for _, size := range schedule_sizes {
+			t.Run(fmt.Sprintf("%s %dx%d", name, size[0], size[1]), func(t *testing.T) {
+				targets, subnets := test_targets(size[0]), test_subnets(size[1])
+				// several runs, every one with other random orders
+				for run := 0; run < 20; run++ {
+					seen := make(map[*Nameserver]map[int]int)
+					jobs := 0
+					scheduler.Schedule(context.Background(), targets, subnets, func(batch []*Job) bool {
+						if len(batch) == 0 {
+							t.Error("empty batch")
+						}
+						for _, job := range batch {
+							if subnets[job.Subnet_index] != job.Subnet {
+								t.Errorf("job with subnet %s at index %d", job.Subnet, job.Subnet_index)
+							}
+							if seen[job.Target] == nil {
+								seen[job.Target] = make(map[int]int)
+							}
+							seen[job.Target][job.Subnet_index]++
+							jobs++
+						}
+						return true
+					})
+					if jobs != len(targets)*len(subnets) {
+						t.Fatalf("%d jobs, want %d", jobs, len(targets)*len(subnets))
+					}
+					for _, target := range targets {
+						for i := range subnets {
+							if seen[target][i] != 1 {
+								t.Fatalf("(%s, %s) emitted %d times", target.Domain, subnets[i], seen[target][i])
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSchedulerBatches(t *testing.T) {
+	targets, subnets := test_targets(4), test_subnets(6)
+	By_domain{}.Schedule(context.Background(), targets, subnets, func(batch []*Job) bool {
+		if len(batch) != len(subnets) {
+			t.Fatalf("batch of %d jobs, want %d", len(batch), len(subnets))
+		}
+		for i, job := range batch {
+			if job.Target != batch[0].Target || job.Subnet_index != i {
+				t.Errorf("job %d of the batch is (%s, %d)", i, job.Target.Domain, job.Subnet_index)
+			}
+		}
+		return true
+	})
+
+	// by subnet, all targets are asked with a subnet before the next one
+	last := 0
+	By_subnet{}.Schedule(context.Background(), targets, subnets, func(batch []*Job) bool {
+		if batch[0].Subnet_index < last {
+			t.Errorf("subnet %d after subnet %d", batch[0].Subnet_index, last)
+		}
+		last = batch[0].Subnet_index
+		return true
+	})
+}
+
+func TestSchedulerStops(t *testing.T) {
+	schedulers := map[string]Scheduler{"subnet": By_subnet{}, "domain": By_domain{}, "random": Randomized{}}
+	for name, scheduler := range schedulers {
+		batches := 0
+		scheduler.Schedule(context.Background(), test_targets(7), test_subnets(13), func(batch []*Job) bool {
+			batches++
+			return batches < 3
+		})
+		if batches != 3 {
+			t.Errorf("%s: %d batches after emit returned false on the third", name, batches)
+		}
+	}
+}
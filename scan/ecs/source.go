@@ -0,0 +1,111 @@
+package ecs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// source addresses
+// the transports send a query from the local address stored in its context with
+// With_source, or from the one the os picks if there is none. Resolver and ECSProber
+// take the addresses from a Source_pool in turn, so that the load is spread over all
+// addresses of a multi-homed vantage point
+
+type source_key struct{}
+
+// With_source makes the transports send the queries of ctx from ip, nil for the default
+func With_source(ctx context.Context, ip net.IP) context.Context {
+	if ip == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, source_key{}, ip)
+}
+
+// Source returns the address set with With_source, nil if there is none
+func Source(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(source_key{}).(net.IP)
+	return ip
+}
+
+// dialer for network (udp or tcp) bound to the source of ctx
+func source_dialer(ctx context.Context, network string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	source := Source(ctx)
+	if source == nil {
+		return dialer
+	}
+	if network == "udp" {
+		dialer.LocalAddr = &net.UDPAddr{IP: source}
+	} else {
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return dialer
+}
+
+// Source_pool hands out local addresses round robin, separately per address family
+// a nil or empty pool always returns nil, i.e. the default address
+type Source_pool struct {
+	v4    []net.IP
+	v6    []net.IP
+	next4 atomic.Uint64
+	next6 atomic.Uint64
+}
+
+func New_source_pool(addrs []net.IP) *Source_pool {
+	pool := &Source_pool{v4: []net.IP{}, v6: []net.IP{}}
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			pool.v4 = append(pool.v4, addr)
+		} else {
+			pool.v6 = append(pool.v6, addr)
+		}
+	}
+	return pool
+}
+
+func (pool *Source_pool) Len() int {
+	if pool == nil {
+		return 0
+	}
+	return len(pool.v4) + len(pool.v6)
+}
+
+// Next returns the next address of the family of server, nil if the pool has none
+func (pool *Source_pool) Next(server net.IP) net.IP {
+	if pool == nil {
+		return nil
+	}
+	addrs, next := pool.v6, &pool.next6
+	if server.To4() != nil {
+		addrs, next = pool.v4, &pool.next4
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[(next.Add(1)-1)%uint64(len(addrs))]
+}
+
+// Interface_addrs returns the global unicast addresses of the network interface name
+func Interface_addrs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip_net, ok := addr.(*net.IPNet); ok && ip_net.IP.IsGlobalUnicast() {
+			ips = append(ips, ip_net.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s has no global unicast address", name)
+	}
+	return ips, nil
+}
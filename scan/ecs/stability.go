@@ -0,0 +1,74 @@
+package ecs
+
+import (
+	"net"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// answer consistency
+// servers that rotate their answers (round robin, random load balancing) look like ecs
+// tailoring if every subnet is only asked once. with repeats, a Scanner asks the same
+// question several times and summarizes the answers per (domain, nameserver, subnet)
+
+// Answer_set is how often one set of answers was returned
+type Answer_set struct {
+	Answers []string // sorted
+	Count   int
+}
+
+// Stability summarizes the repeated queries of one (domain, nameserver, subnet)
+type Stability struct {
+	Domain      string
+	Nameserver  net.IP
+	Subnet      *net.IPNet // nil for the baseline query without ECS option
+	Baseline    bool
+	Queries     int
+	Answered    int
+	Answer_sets []*Answer_set // most frequent first
+	// share of the answered queries that returned the most frequent answer set,
+	// 1 for a server that always gives the same answer, 0 if nothing was answered
+	Score float64
+}
+
+// New_stability summarizes results, which all have to be answers to the same question
+func New_stability(results []*Result) *Stability {
+	stability := &Stability{Answer_sets: []*Answer_set{}}
+	if len(results) == 0 {
+		return stability
+	}
+	stability.Domain = results[0].Domain
+	stability.Nameserver = results[0].Nameserver
+	stability.Subnet = results[0].Subnet
+	stability.Baseline = results[0].Baseline
+	stability.Queries = len(results)
+	sets := make(map[string]*Answer_set)
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		stability.Answered++
+		answers := make([]string, 0, len(result.Answers))
+		for _, ip := range result.Answers {
+			answers = append(answers, ip.String())
+		}
+		slices.Sort(answers)
+		answers = slices.Compact(answers)
+		key := strings.Join(answers, ",")
+		if set, ok := sets[key]; ok {
+			set.Count++
+		} else {
+			set = &Answer_set{Answers: answers, Count: 1}
+			sets[key] = set
+			stability.Answer_sets = append(stability.Answer_sets, set)
+		}
+	}
+	sort.SliceStable(stability.Answer_sets, func(i, j int) bool {
+		return stability.Answer_sets[i].Count > stability.Answer_sets[j].Count
+	})
+	if stability.Answered != 0 {
+		stability.Score = float64(stability.Answer_sets[0].Count) / float64(stability.Answered)
+	}
+	return stability
+}
@@ -0,0 +1,74 @@
+package ecs
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// a result for example.com. from 192.0.2.53 with 203.0.113.0/24, scope is the
+// prefix length of the answer and answers its ips, a failed query if err is set
+func stability_result(scope int, err error, answers ...string) *Result {
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	result := &Result{Domain: "example.com.", Nameserver: net.ParseIP("192.0.2.53"), Subnet: subnet, Err: err}
+	if err != nil {
+		return result
+	}
+	result.Returned_subnet = subnet
+	result.Scope = net.CIDRMask(scope, 32)
+	for _, answer := range answers {
+		result.Answers = append(result.Answers, net.ParseIP(answer))
+	}
+	return result
+}
+
+func TestNewStability(t *testing.T) {
+	timeout := errors.New("timeout")
+	tests := []struct {
+		name     string
+		results  []*Result
+		answered int
+		sets     []*Answer_set
+		score    float64
+	}{
+		{"no results", nil, 0, []*Answer_set{}, 0},
+		{"identical repeats",
+			[]*Result{stability_result(24, nil, "198.51.100.1"), stability_result(24, nil, "198.51.100.1"), stability_result(24, nil, "198.51.100.1")},
+			3, []*Answer_set{{Answers: []string{"198.51.100.1"}, Count: 3}}, 1},
+		{"same set in another order and with duplicates",
+			[]*Result{stability_result(24, nil, "198.51.100.2", "198.51.100.1"), stability_result(24, nil, "198.51.100.1", "198.51.100.2", "198.51.100.1")},
+			2, []*Answer_set{{Answers: []string{"198.51.100.1", "198.51.100.2"}, Count: 2}}, 1},
+		// only the answers count, the scope is in the scan rows
+		{"changing scope",
+			[]*Result{stability_result(24, nil, "198.51.100.1"), stability_result(16, nil, "198.51.100.1"), stability_result(0, nil, "198.51.100.1")},
+			3, []*Answer_set{{Answers: []string{"198.51.100.1"}, Count: 3}}, 1},
+		{"changing answers, the most frequent first",
+			[]*Result{stability_result(24, nil, "198.51.100.1"), stability_result(24, nil, "198.51.100.2"), stability_result(24, nil, "198.51.100.2"), stability_result(24, nil)},
+			4, []*Answer_set{{Answers: []string{"198.51.100.2"}, Count: 2}, {Answers: []string{"198.51.100.1"}, Count: 1}, {Answers: []string{}, Count: 1}}, 0.5},
+		{"some failing",
+			[]*Result{stability_result(24, timeout), stability_result(24, nil, "198.51.100.1"), stability_result(24, nil, "198.51.100.1"), stability_result(24, timeout)},
+			2, []*Answer_set{{Answers: []string{"198.51.100.1"}, Count: 2}}, 1},
+		{"all failing",
+			[]*Result{stability_result(24, timeout), stability_result(24, timeout), stability_result(24, timeout)},
+			0, []*Answer_set{}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stability := New_stability(test.results)
+			if stability.Queries != len(test.results) || stability.Answered != test.answered {
+				t.Errorf("%d queries, %d answered, want %d, %d", stability.Queries, stability.Answered, len(test.results), test.answered)
+			}
+			if !reflect.DeepEqual(stability.Answer_sets, test.sets) {
+				t.Errorf("answer sets %v, want %v", stability.Answer_sets, test.sets)
+			}
+			if stability.Score != test.score {
+				t.Errorf("score %f, want %f", stability.Score, test.score)
+			}
+			if len(test.results) != 0 && (stability.Domain != "example.com." || !stability.Nameserver.Equal(net.ParseIP("192.0.2.53")) ||
+				stability.Subnet.String() != "203.0.113.0/24" || stability.Baseline) {
+				t.Errorf("question %s %s %s baseline %t", stability.Domain, stability.Nameserver, stability.Subnet, stability.Baseline)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package ecs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transport sends msg to server (ip:port) and returns the answer and its rtt
+// qid identifies the query within the run, e.g. to match it with a packet capture
+type Transport interface {
+	Exchange(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error)
+}
+
+// Exchange_func turns a function into a Transport, e.g. to wrap another one or to
+// answer from a table in tests
+type Exchange_func func(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error)
+
+func (f Exchange_func) Exchange(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+	return f(ctx, msg, server, qid)
+}
+
+// names accepted by New_transport
+var Transport_names = []string{"udp", "tcp", "tls", "https"}
+
+// New_transport returns the transport called name
+// port replaces the port of the servers if set, tls and https default to 853 and 443
+// tls_config is only used by tls and https
+func New_transport(name string, timeout time.Duration, port string, tls_config *tls.Config) (Transport, error) {
+	switch name {
+	case "udp":
+		return &Udp_transport{Timeout: timeout, Port: port}, nil
+	case "tcp":
+		return &Tcp_transport{Timeout: timeout, Port: port}, nil
+	case "tls":
+		if port == "" {
+			port = "853"
+		}
+		return &Tls_transport{Timeout: timeout, Port: port, Config: tls_config}, nil
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+		return &Https_transport{Timeout: timeout, Port: port, Path: "/dns-query", Config: tls_config}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+// replaces the port of server, if one is given
+func with_port(server string, port string) string {
+	if port == "" {
+		return server
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// exchanges msg over a fresh connection of client, sent from the source of ctx
+func exchange_conn(ctx context.Context, client *dns.Client, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	network := "udp"
+	if client.Net != "udp" {
+		network = "tcp"
+	}
+	client.Dialer = source_dialer(ctx, network, client.Timeout)
+	conn, err := client.DialContext(ctx, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	// the dns client only honours the deadline of ctx, not its cancellation
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	return client.ExchangeWithConnContext(ctx, msg, conn)
+}
+
+// Udp_transport is plain dns over udp, the default
+type Udp_transport struct {
+	Timeout time.Duration
+	Port    string
+}
+
+func (t *Udp_transport) Exchange(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: "udp", Timeout: t.Timeout}
+	return exchange_conn(ctx, client, msg, with_port(server, t.Port))
+}
+
+// Dial opens the socket a query to server would be sent from, for callers that want to
+// handle the wire messages themselves
+func (t *Udp_transport) Dial(ctx context.Context, server string) (*dns.Conn, error) {
+	client := &dns.Client{Net: "udp", Timeout: t.Timeout, Dialer: source_dialer(ctx, "udp", t.Timeout)}
+	return client.DialContext(ctx, with_port(server, t.Port))
+}
+
+// Tcp_transport is plain dns over tcp, one connection per query
+type Tcp_transport struct {
+	Timeout time.Duration
+	Port    string
+}
+
+func (t *Tcp_transport) Exchange(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: "tcp", Timeout: t.Timeout}
+	return exchange_conn(ctx, client, msg, with_port(server, t.Port))
+}
+
+// Tls_transport is dns over tls (RFC 7858), one connection per query
+// the rtt does not include the handshake
+type Tls_transport struct {
+	Timeout time.Duration
+	Port    string
+	Config  *tls.Config
+}
+
+func (t *Tls_transport) Exchange(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: "tcp-tls", Timeout: t.Timeout, TLSConfig: t.Config}
+	return exchange_conn(ctx, client, msg, with_port(server, t.Port))
+}
+
+// Https_transport is dns over https (RFC 8484) with POST requests to https://server/Path
+// connections are kept open between queries, only the first rtt to a server includes
+// the handshake
+type Https_transport struct {
+	Timeout time.Duration
+	Port    string
+	Path    string
+	Config  *tls.Config
+
+	clients_mu sync.Mutex
+	clients    map[string]*http.Client // per source address, so connections are only reused from the same one
+}
+
+func (t *Https_transport) http_client(source net.IP) *http.Client {
+	t.clients_mu.Lock()
+	defer t.clients_mu.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[string]*http.Client)
+	}
+	key := source.String()
+	if client, ok := t.clients[key]; ok {
+		return client
+	}
+	dialer := source_dialer(With_source(context.Background(), source), "tcp", t.Timeout)
+	client := &http.Client{
+		Timeout: t.Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     t.Config,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 16,
+		},
+	}
+	t.clients[key] = client
+	return client
+}
+
+func (t *Https_transport) Exchange(ctx context.Context, msg *dns.Msg, server string, qid uint64) (*dns.Msg, time.Duration, error) {
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	url := "https://" + with_port(server, t.Port) + t.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	t_start := time.Now()
+	resp, err := t.http_client(Source(ctx)).Do(req)
+	if err != nil {
+		return nil, time.Since(t_start), err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	rtt := time.Since(t_start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	rec := new(dns.Msg)
+	if err := rec.Unpack(body); err != nil {
+		return rec, rtt, err
+	}
+	return rec, rtt, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// enrichment
+// annotates the request subnet, the nameserver and every answer of a scan file with
+// country, continent and asn from the mmdb databases in mmdb_paths and writes the
+// format df_logic.load_enriched_csv reads. the locations keep the python tuple format
+// (lat, long, country, accuracy radius, continent) of df_logic.create_enriched_data,
+// the accuracy radius slot carries the asn instead. ns-as is the name of the as of the
+// nameserver, prefixed with its asn and followed by its country: "AS3320 Deutsche
+// Telekom AG (DE)"
+// the csv format will be as follows:
+// timestamp;domain;nameserver-ip;[ns-as];subnet-ip;subnet-prefix;subnet-location;[ans-subnet-cidr];[ans-scope];[ip1,ip2,...];[ip-locations];[average-distance]
+// the average distance is left empty, the databases have no coordinates
+
+func py_str(s string) string {
+	if s == "" {
+		return "None"
+	}
+	return "'" + strings.ReplaceAll(s, "'", "\\'") + "'"
+}
+
+func (info *geo_info) py_location() string {
+	return fmt.Sprintf("(None, None, %s, %s, %s)", py_str(info.country), py_str(info.asn), py_str(info.continent))
+}
+
+// the ns-as column, the fields the databases dont know are left out
+func (info *geo_info) ns_as() string {
+	parts := make([]string, 0, 3)
+	for _, part := range []string{info.asn, info.as_name} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if info.country != "" {
+		parts = append(parts, "("+info.country+")")
+	}
+	return strings.Join(parts, " ")
+}
+
+func enrich_row(db *geo_db, records []string) []string {
+	ns := db.lookup(net.ParseIP(records[2]))
+	subnet_ip, subnet_prefix, _ := strings.Cut(records[3], "/")
+	subnet_location := ""
+	if subnet_ip != "" {
+		subnet_location = db.lookup(net.ParseIP(subnet_ip)).py_location()
+	}
+	ip_locations := ""
+	if records[6] != "" {
+		ips := strings.Split(records[6], ",")
+		locations := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			locations = append(locations, db.lookup(net.ParseIP(ip)).py_location())
+		}
+		ip_locations = "[" + strings.Join(locations, ", ") + "]"
+	}
+	return []string{
+		records[0], records[1], records[2], ns.ns_as(),
+		subnet_ip, subnet_prefix, subnet_location,
+		records[4], records[5], records[6],
+		ip_locations, "",
+	}
+}
+
+// streams the scan file in_path into the enriched file out_path
+func enrich(db *geo_db, in_path string, out_path string) (int, error) {
+	in_file, err := os.Open(in_path)
+	if err != nil {
+		return 0, err
+	}
+	defer in_file.Close()
+	zip_reader, err := gzip.NewReader(in_file)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", in_path, err)
+	}
+	defer zip_reader.Close()
+	csv_reader := csv.NewReader(zip_reader)
+	csv_reader.Comma = ';'
+	csv_reader.FieldsPerRecord = -1
+	csv_reader.ReuseRecord = true
+
+	out_file, err := os.Create(out_path)
+	if err != nil {
+		return 0, err
+	}
+	defer out_file.Close()
+	zip_writer := gzip.NewWriter(out_file)
+	csv_writer := csv.NewWriter(zip_writer)
+	csv_writer.Comma = ';'
+
+	rows := 0
+	for {
+		records, err := csv_reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return rows, fmt.Errorf("%s: %w", in_path, err)
+		}
+		if len(records) < 7 {
+			line, _ := csv_reader.FieldPos(0)
+			return rows, fmt.Errorf("%s:%d: expected at least 7 fields, got %d", in_path, line, len(records))
+		}
+		if err := csv_writer.Write(enrich_row(db, records)); err != nil {
+			return rows, err
+		}
+		rows++
+		if rows%1000000 == 0 {
+			log_main.Info("enriching", "rows", rows)
+		}
+	}
+	csv_writer.Flush()
+	return rows, errors.Join(csv_writer.Error(), zip_writer.Close(), out_file.Close())
+}
+
+func cmd_enrich(args []string) error {
+	fs := new_flag_set("enrich", "<scan.csv.gz> <enriched.csv.gz>")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("enrich needs the scan file and the file to write")
+	}
+	db, err := open_geo_db(cfg.Mmdb_paths)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+	t_start := time.Now()
+	rows, err := enrich(db, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	log_main.Info("enriched", "path", fs.Arg(1), "rows", rows, "took", time.Since(t_start))
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// a minimal mmdb writer (ipv4 tree, 24 bit records), so that the tests need no
+// downloaded databases
+
+type mmdb_pair struct {
+	key   string
+	value any
+}
+
+// a map with the keys in the order they are written
+type mmdb_map []mmdb_pair
+
+type mmdb_uint16 uint16
+
+// the control byte, the extended type and the size extension (sizes below 285)
+func mmdb_ctrl(data_type int, size int) []byte {
+	ext := []byte{}
+	if data_type > 7 {
+		ext = append(ext, byte(data_type-7))
+		data_type = 0
+	}
+	if size < 29 {
+		return append([]byte{byte(data_type<<5 | size)}, ext...)
+	}
+	return append(append([]byte{byte(data_type<<5 | 29)}, ext...), byte(size-29))
+}
+
+func mmdb_uint(data_type int, v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return append(mmdb_ctrl(data_type, len(b)), b...)
+}
+
+func mmdb_value(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdb_ctrl(2, len(v)), v...)
+	case mmdb_uint16:
+		return mmdb_uint(5, uint64(v))
+	case uint32:
+		return mmdb_uint(6, uint64(v))
+	case uint64:
+		return mmdb_uint(9, v)
+	case []any:
+		out := mmdb_ctrl(11, len(v))
+		for _, x := range v {
+			out = append(out, mmdb_value(x)...)
+		}
+		return out
+	case mmdb_map:
+		out := mmdb_ctrl(7, len(v))
+		for _, pair := range v {
+			out = append(out, mmdb_value(pair.key)...)
+			out = append(out, mmdb_value(pair.value)...)
+		}
+		return out
+	}
+	panic("unsupported mmdb value")
+}
+
+// writes the records under their networks (ipv4, not nested) to path
+func write_test_mmdb(t *testing.T, path string, records map[string]mmdb_map) {
+	t.Helper()
+	type node struct {
+		// child node index, or data offset + 1 << 31 for a record
+		children [2]int
+	}
+	const empty, data_flag = -1, 1 << 31
+	nodes := []*node{{children: [2]int{empty, empty}}}
+	data := []byte{}
+	networks := make([]string, 0, len(records))
+	for network := range records {
+		networks = append(networks, network)
+	}
+	slices.Sort(networks)
+	for _, network := range networks {
+		_, ip_net, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := len(data)
+		data = append(data, mmdb_value(records[network])...)
+		ones, _ := ip_net.Mask.Size()
+		ip := binary.BigEndian.Uint32(ip_net.IP.To4())
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip>>(31-i)) & 1
+			if i == ones-1 {
+				nodes[current].children[bit] = data_flag + offset
+				break
+			}
+			if nodes[current].children[bit] == empty {
+				nodes = append(nodes, &node{children: [2]int{empty, empty}})
+				nodes[current].children[bit] = len(nodes) - 1
+			}
+			current = nodes[current].children[bit]
+		}
+	}
+	count := len(nodes)
+	out := []byte{}
+	for _, n := range nodes {
+		for _, child := range n.children {
+			record := child
+			switch {
+			case child == empty:
+				record = count
+			case child >= data_flag:
+				record = count + 16 + child - data_flag
+			}
+			out = append(out, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, "\xab\xcd\xefMaxMind.com"...)
+	out = append(out, mmdb_value(mmdb_map{
+		{"node_count", uint32(count)},
+		{"record_size", mmdb_uint16(24)},
+		{"ip_version", mmdb_uint16(4)},
+		{"database_type", "test"},
+		{"languages", []any{"en"}},
+		{"binary_format_major_version", mmdb_uint16(2)},
+		{"binary_format_minor_version", mmdb_uint16(0)},
+		{"build_epoch", uint64(1700000000)},
+		{"description", mmdb_map{{"en", "test"}}},
+	})...)
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write_gz_csv(t *testing.T, path string, rows [][]string) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zip_writer := gzip.NewWriter(file)
+	csv_writer := csv.NewWriter(zip_writer)
+	csv_writer.Comma = ';'
+	csv_writer.WriteAll(rows)
+	if err := csv_writer.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zip_writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read_gz_csv(t *testing.T, path string) [][]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zip_reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv_reader := csv.NewReader(zip_reader)
+	csv_reader.Comma = ';'
+	csv_reader.FieldsPerRecord = -1
+	rows, err := csv_reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestEnrich(t *testing.T) {
+	dir := t.TempDir()
+	// an ipinfo database and a maxmind country and asn pair, combined
+	ipinfo_path := filepath.Join(dir, "country_asn.mmdb")
+	write_test_mmdb(t, ipinfo_path, map[string]mmdb_map{
+		"10.0.0.0/16": {{"country", "DE"}, {"continent", "EU"}, {"asn", "AS3320"}, {"as_name", "Deutsche Telekom AG"}},
+		"5.5.5.0/24":  {{"country", "US"}, {"continent", "NA"}, {"asn", "AS15169"}, {"as_name", "Google LLC"}},
+		"1.1.1.0/24":  {{"country", "AU"}, {"continent", "OC"}, {"asn", "AS13335"}, {"as_name", "Cloudflare, Inc."}},
+	})
+	country_path := filepath.Join(dir, "GeoLite2-Country.mmdb")
+	write_test_mmdb(t, country_path, map[string]mmdb_map{
+		"7.7.7.0/24": {{"country", mmdb_map{{"iso_code", "JP"}}}, {"continent", mmdb_map{{"code", "AS"}}}},
+	})
+	asn_path := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	write_test_mmdb(t, asn_path, map[string]mmdb_map{
+		"7.7.0.0/16": {{"autonomous_system_number", uint32(2497)}, {"autonomous_system_organization", "IIJ"}},
+	})
+	db, err := open_geo_db([]string{ipinfo_path, country_path, asn_path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	lookups := []struct {
+		ip   string
+		want geo_info
+	}{
+		{"10.0.1.0", geo_info{country: "DE", continent: "EU", asn: "AS3320", as_name: "Deutsche Telekom AG"}},
+		{"1.1.1.1", geo_info{country: "AU", continent: "OC", asn: "AS13335", as_name: "Cloudflare, Inc."}},
+		{"5.5.5.5", geo_info{country: "US", continent: "NA", asn: "AS15169", as_name: "Google LLC"}},
+		{"7.7.7.7", geo_info{country: "JP", continent: "AS", asn: "AS2497", as_name: "IIJ"}},
+		{"7.7.8.8", geo_info{asn: "AS2497", as_name: "IIJ"}},
+		{"9.9.9.9", geo_info{}},
+	}
+	for _, lookup := range lookups {
+		if got := db.lookup(net.ParseIP(lookup.ip)); *got != lookup.want {
+			t.Errorf("lookup(%s) = %+v, want %+v", lookup.ip, *got, lookup.want)
+		}
+	}
+
+	in_path := filepath.Join(dir, "scan.csv.gz")
+	out_path := filepath.Join(dir, "enriched.csv.gz")
+	write_gz_csv(t, in_path, [][]string{
+		{"2026-01-01 00:00:00.000000", "example.com.", "1.1.1.1", "10.0.1.0/24", "10.0.1.0/24", "24", "5.5.5.5,7.7.7.7,9.9.9.9", "1", "3.2", ""},
+		{"2026-01-01 00:00:01.000000", "example.org.", "7.7.7.7", "", "", "", "", "2", "", ""},
+	})
+	rows, err := enrich(db, in_path, out_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Fatalf("enrich wrote %d rows, want 2", rows)
+	}
+	want := [][]string{
+		{"2026-01-01 00:00:00.000000", "example.com.", "1.1.1.1", "AS13335 Cloudflare, Inc. (AU)",
+			"10.0.1.0", "24", "(None, None, 'DE', 'AS3320', 'EU')",
+			"10.0.1.0/24", "24", "5.5.5.5,7.7.7.7,9.9.9.9",
+			"[(None, None, 'US', 'AS15169', 'NA'), (None, None, 'JP', 'AS2497', 'AS'), (None, None, None, None, None)]", ""},
+		{"2026-01-01 00:00:01.000000", "example.org.", "7.7.7.7", "AS2497 IIJ (JP)",
+			"", "", "",
+			"", "", "",
+			"", ""},
+	}
+	got := read_gz_csv(t, out_path)
+	if len(got) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !slices.Equal(got[i], want[i]) {
+			t.Errorf("row %d:\n got %q\nwant %q", i, got[i], want[i])
+		}
+	}
+}
+
+// country, asn and continent of every address, by the slots of the location tuples
+func TestEnrichRowFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "country_asn.mmdb")
+	write_test_mmdb(t, path, map[string]mmdb_map{
+		"10.0.0.0/16": {{"country", "DE"}, {"continent", "EU"}, {"asn", "AS3320"}, {"as_name", "Deutsche Telekom AG"}},
+		"5.5.5.0/24":  {{"country", "US"}, {"continent", "NA"}, {"asn", "AS15169"}},
+		"1.1.1.0/24":  {{"country", "AU"}, {"continent", "OC"}, {"asn", "AS13335"}, {"as_name", "Cloudflare, Inc."}},
+	})
+	db, err := open_geo_db([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	row := enrich_row(db, []string{"2026-01-01 00:00:00.000000", "example.com.", "10.0.0.53", "1.1.1.0/24", "", "", "5.5.5.5,10.0.7.7"})
+	if len(row) != 12 {
+		t.Fatalf("%d columns, want 12", len(row))
+	}
+	if row[3] != "AS3320 Deutsche Telekom AG (DE)" {
+		t.Errorf("ns-as = %q", row[3])
+	}
+	// (lat, long, country, asn, continent)
+	fields := func(location string) []string {
+		location = strings.Trim(location, "()")
+		parts := strings.Split(location, ", ")
+		for i := range parts {
+			parts[i] = strings.Trim(parts[i], "'")
+		}
+		return parts
+	}
+	locations := []string{row[6]}
+	locations = append(locations, strings.Split(strings.Trim(row[10], "[]"), "), (")...)
+	want := [][]string{
+		{"None", "None", "AU", "AS13335", "OC"}, // subnet
+		{"None", "None", "US", "AS15169", "NA"}, // answers
+		{"None", "None", "DE", "AS3320", "EU"},
+	}
+	if len(locations) != len(want) {
+		t.Fatalf("locations %q", locations)
+	}
+	for i, location := range locations {
+		if got := fields(location); !slices.Equal(got, want[i]) {
+			t.Errorf("location %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	// a nameserver the databases know only partly, and one they dont know
+	if got := enrich_row(db, []string{"", "", "5.5.5.53", "", "", "", ""})[3]; got != "AS15169 (US)" {
+		t.Errorf("ns-as = %q, want AS15169 (US)", got)
+	}
+	if got := enrich_row(db, []string{"", "", "9.9.9.9", "", "", "", ""})[3]; got != "" {
+		t.Errorf("ns-as = %q for an unknown nameserver", got)
+	}
+}
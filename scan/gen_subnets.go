@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// subnet list generation
+// builds a subnet list from the routed prefixes in rib_fname: the prefixes are grouped
+// by (country of their first address, origin as) and of every group the largest
+// prefix is taken, the lowest one of those that are equally large. its first subnet of
+// gen_prefix_v4 or gen_prefix_v6 bits goes to the list
+// prefixes more specific than that, of the gen_exclude_asns and gen_exclude_countries,
+// non-global ones and those whose subnet is on the blocklist are skipped
+// the csv format will be as follows:
+// subnet-cidr,routed-prefix,origin-as,[country],[continent],prefixes-of-group
+// read_subnets only reads the first column
+
+type subnet_group struct {
+	country   string
+	continent string
+	origin    uint32
+	prefix    *net.IPNet // the largest prefix of the group
+	subnet    *net.IPNet
+	prefixes  int
+}
+
+// as numbers with or without the AS prefix
+func parse_asn(s string) (uint32, error) {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+	return uint32(asn), err
+}
+
+// the first subnet of prefix with the configured size of its family, nil if the
+// family is disabled or prefix is too small
+func first_subnet(prefix *net.IPNet) *net.IPNet {
+	ones, bits := prefix.Mask.Size()
+	size := cfg.Gen_prefix_v6
+	if bits == 32 {
+		size = cfg.Gen_prefix_v4
+	}
+	if size == 0 || ones > size {
+		return nil
+	}
+	mask := net.CIDRMask(size, bits)
+	return &net.IPNet{IP: prefix.IP.Mask(mask), Mask: mask}
+}
+
+func larger_prefix(a *net.IPNet, b *net.IPNet) bool {
+	a_ones, _ := a.Mask.Size()
+	b_ones, _ := b.Mask.Size()
+	if a_ones != b_ones {
+		return a_ones < b_ones
+	}
+	return bytes.Compare(a.IP, b.IP) < 0
+}
+
+func overlaps_blocklist(subnet *net.IPNet) bool {
+	for _, blocked_net := range blocked_nets {
+		if blocked_net.Contains(subnet.IP) || subnet.Contains(blocked_net.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func group_prefixes(db *geo_db) (map[string]*subnet_group, error) {
+	exclude_asns := make(map[uint32]bool)
+	for _, s := range cfg.Gen_exclude_asns {
+		asn, _ := parse_asn(s)
+		exclude_asns[asn] = true
+	}
+	groups := make(map[string]*subnet_group)
+	read, skipped := 0, 0
+	err := read_rib(cfg.Rib_fname, func(prefix *net.IPNet, origin uint32) {
+		read++
+		subnet := first_subnet(prefix)
+		if subnet == nil || exclude_asns[origin] {
+			skipped++
+			return
+		}
+		if !subnet.IP.IsGlobalUnicast() || subnet.IP.IsPrivate() || overlaps_blocklist(subnet) {
+			skipped++
+			return
+		}
+		info := db.lookup(subnet.IP)
+		if info.country != "" && slices.Contains(cfg.Gen_exclude_countries, info.country) {
+			skipped++
+			return
+		}
+		key := info.country + "|" + strconv.FormatUint(uint64(origin), 10)
+		group, ok := groups[key]
+		if !ok {
+			group = &subnet_group{country: info.country, continent: info.continent, origin: origin}
+			groups[key] = group
+		}
+		group.prefixes++
+		if group.prefix == nil || larger_prefix(prefix, group.prefix) {
+			group.prefix = prefix
+			group.subnet = subnet
+		}
+	})
+	log_main.Info("read routed prefixes", "path", cfg.Rib_fname, "prefixes", read, "skipped", skipped, "groups", len(groups))
+	return groups, err
+}
+
+func write_subnets(path string, groups map[string]*subnet_group) error {
+	sorted := make([]*subnet_group, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	slices.SortFunc(sorted, func(a *subnet_group, b *subnet_group) int {
+		if a.country != b.country {
+			return strings.Compare(a.country, b.country)
+		}
+		if a.origin != b.origin {
+			return cmp.Compare(a.origin, b.origin)
+		}
+		return bytes.Compare(a.subnet.IP, b.subnet.IP)
+	})
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	csv_writer := csv.NewWriter(file)
+	for _, group := range sorted {
+		csv_writer.Write([]string{group.subnet.String(), group.prefix.String(), strconv.FormatUint(uint64(group.origin), 10),
+			group.country, group.continent, strconv.Itoa(group.prefixes)})
+	}
+	csv_writer.Flush()
+	return errors.Join(csv_writer.Error(), file.Close())
+}
+
+func cmd_gen_subnets(args []string) error {
+	fs := new_flag_set("gen-subnets", "<subnets.txt>")
+	load := cfg_flags(fs)
+	fs.Parse(args)
+	if err := load(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("gen-subnets needs the file to write the subnets to")
+	}
+	exclude_ips()
+	db, err := open_geo_db(cfg.Mmdb_paths)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+	groups, err := group_prefixes(db)
+	if err != nil {
+		return err
+	}
+	if err := write_subnets(fs.Arg(0), groups); err != nil {
+		return err
+	}
+	log_main.Info("subnets written", "path", fs.Arg(0), "subnets", len(groups))
+	fmt.Println(len(groups), "subnets written to", fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geolocation and asn lookups
+// reads mmdb databases in the ipinfo format (country, continent, asn and as_name at
+// the top level) and in the maxmind format (country.iso_code, continent.code,
+// autonomous_system_number and autonomous_system_organization), so that e.g. a
+// GeoLite2 country and asn database can be combined. every field is taken from the
+// first database that has it
+
+type geo_info struct {
+	country   string // iso code
+	continent string // code
+	asn       string // AS<number>
+	as_name   string
+}
+
+type geo_db struct {
+	readers []*maxminddb.Reader
+	// every record is decoded only once, per reader by its offset
+	records []map[uintptr]*geo_info
+}
+
+func open_geo_db(paths []string) (*geo_db, error) {
+	db := &geo_db{readers: []*maxminddb.Reader{}, records: []map[uintptr]*geo_info{}}
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			db.close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		log_main.Info("opened mmdb", "path", path, "type", reader.Metadata.DatabaseType, "nodes", reader.Metadata.NodeCount)
+		db.readers = append(db.readers, reader)
+		db.records = append(db.records, make(map[uintptr]*geo_info))
+	}
+	return db, nil
+}
+
+func (db *geo_db) close() error {
+	errs := make([]error, 0)
+	for _, reader := range db.readers {
+		errs = append(errs, reader.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// a string at key, or the string at sub_key of the map at key
+func record_str(record map[string]any, key string, sub_key string) string {
+	switch value := record[key].(type) {
+	case string:
+		return value
+	case map[string]any:
+		if s, ok := value[sub_key].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func decode_geo_info(record map[string]any) *geo_info {
+	info := &geo_info{
+		country:   record_str(record, "country", "iso_code"),
+		continent: record_str(record, "continent", "code"),
+		asn:       record_str(record, "asn", ""),
+		as_name:   record_str(record, "as_name", ""),
+	}
+	if number, ok := record["autonomous_system_number"].(uint64); ok && info.asn == "" {
+		info.asn = fmt.Sprintf("AS%d", number)
+	}
+	if info.as_name == "" {
+		info.as_name = record_str(record, "autonomous_system_organization", "")
+	}
+	return info
+}
+
+// lookup returns what the databases know about ip, empty fields for what they dont
+func (db *geo_db) lookup(ip net.IP) *geo_info {
+	info := &geo_info{}
+	if ip == nil {
+		return info
+	}
+	for i, reader := range db.readers {
+		offset, err := reader.LookupOffset(ip)
+		if err != nil || offset == maxminddb.NotFound {
+			continue
+		}
+		found, ok := db.records[i][offset]
+		if !ok {
+			record := make(map[string]any)
+			if err := reader.Decode(offset, &record); err != nil {
+				log_main.Debug("decoding mmdb record", "ip", ip, "err", err)
+				continue
+			}
+			found = decode_geo_info(record)
+			db.records[i][offset] = found
+		}
+		info.merge(found)
+	}
+	return info
+}
+
+// fills in the empty fields of info from other
+func (info *geo_info) merge(other *geo_info) {
+	if info.country == "" {
+		info.country = other.country
+	}
+	if info.continent == "" {
+		info.continent = other.continent
+	}
+	if info.asn == "" {
+		info.asn = other.asn
+	}
+	if info.as_name == "" {
+		info.as_name = other.as_name
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// logging
+// every subsystem has its own logger, so that e.g. the resolver can be debugged
+// without drowning in the output of the writers
+// the default level follows verbosity, log_levels overrides it per subsystem
+// ("resolver=debug") and log_format switches between text and json lines
+
+const level_trace = slog.LevelDebug - 4
+const level_off = slog.Level(100)
+
+var log_subsystems = []string{"main", "resolver", "ecs", "writer", "probe", "echo"}
+
+var (
+	log_main     *slog.Logger
+	log_resolver *slog.Logger
+	log_ecs      *slog.Logger
+	log_writer   *slog.Logger
+	log_probe    *slog.Logger
+	log_echo     *slog.Logger
+)
+
+func init() {
+	setup_logging()
+}
+
+// the original verbosity scale: 0 off, 1-3 info, 4 debug, 5 trace
+func verbosity_level(verbosity int) slog.Level {
+	switch {
+	case verbosity <= 0:
+		return level_off
+	case verbosity <= 3:
+		return slog.LevelInfo
+	case verbosity == 4:
+		return slog.LevelDebug
+	}
+	return level_trace
+}
+
+func parse_level(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "off":
+		return level_off, nil
+	case "trace":
+		return level_trace, nil
+	}
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// parses the subsystem=level entries of log_levels
+func parse_log_levels(entries []string) (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		name, level_str, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("log_levels entry %q is not subsystem=level", entry)
+		}
+		if !slices.Contains(log_subsystems, name) {
+			return nil, fmt.Errorf("unknown log subsystem %q, expected one of %s", name, strings.Join(log_subsystems, ","))
+		}
+		level, err := parse_level(level_str)
+		if err != nil {
+			return nil, fmt.Errorf("log_levels entry %q: %w", entry, err)
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+func level_name(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := attr.Value.Any().(slog.Level); ok && level <= level_trace {
+			attr.Value = slog.StringValue("TRACE")
+		}
+	}
+	return attr
+}
+
+// (re)builds the loggers from the loaded config
+func setup_logging() error {
+	levels, err := parse_log_levels(cfg.Log_levels)
+	if err != nil {
+		return err
+	}
+	logger := func(name string) *slog.Logger {
+		level, ok := levels[name]
+		if !ok {
+			level = verbosity_level(cfg.Verbosity)
+		}
+		opts := &slog.HandlerOptions{Level: level, ReplaceAttr: level_name}
+		var handler slog.Handler
+		if cfg.Log_format == "json" {
+			handler = slog.NewJSONHandler(os.Stderr, opts)
+		} else {
+			handler = slog.NewTextHandler(os.Stderr, opts)
+		}
+		return slog.New(handler).With("subsystem", name)
+	}
+	log_main = logger("main")
+	log_resolver = logger("resolver")
+	log_ecs = logger("ecs")
+	log_writer = logger("writer")
+	log_probe = logger("probe")
+	log_echo = logger("echo")
+	return nil
+}
+
+func log_trace(logger *slog.Logger, msg string, args ...any) {
+	logger.Log(context.Background(), level_trace, msg, args...)
+}
+
+// logs the error and ends the program, for input files that cannot be read
+// it is printed even if logging is turned off
+func fatal(msg string, args ...any) {
+	logger := log_main
+	if !logger.Enabled(context.Background(), slog.LevelError) {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil)).With("subsystem", "main")
+	}
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
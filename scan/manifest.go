@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ecs/ecs"
+)
+
+// run manifest
+// written next to the results at the end of every run, so that it is clear
+// how they were produced and runs can be compared with each other
+
+type manifest_input struct {
+	Key    string `json:"key"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type manifest_phase struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type manifest_counters struct {
+	Queries_sent uint64 `json:"queries_sent"`
+	Errors       uint64 `json:"errors"`
+	Rows_written uint64 `json:"rows_written"`
+	Ns_written   uint64 `json:"ns_written"`
+}
+
+type run_manifest struct {
+	Run_id      string            `json:"run_id"`
+	Command     string            `json:"command"`
+	Round       int               `json:"round,omitempty"`
+	Args        []string          `json:"args"`
+	Version     string            `json:"scanner_version"`
+	Go_version  string            `json:"go_version"`
+	Vantage_ip  string            `json:"vantage_ip"`
+	Started     time.Time         `json:"started"`
+	Finished    time.Time         `json:"finished"`
+	Interrupted bool              `json:"interrupted"`
+	Phases      []*manifest_phase `json:"phases"`
+	Counters    manifest_counters `json:"counters"`
+	Inputs      []*manifest_input `json:"inputs"`
+	Config      map[string]any    `json:"config"`
+}
+
+// counters of the whole run
+var stat_queries atomic.Uint64
+var stat_errors atomic.Uint64
+var stat_rows atomic.Uint64
+var stat_ns_rows atomic.Uint64
+
+var run_command string = "full"
+var phases []*manifest_phase = []*manifest_phase{}
+var phases_mu sync.Mutex
+
+// starts the phases and counters over, for the next round of repeat
+func reset_stats() {
+	phases_mu.Lock()
+	phases = []*manifest_phase{}
+	phases_mu.Unlock()
+	stat_queries.Store(0)
+	stat_errors.Store(0)
+	stat_rows.Store(0)
+	stat_ns_rows.Store(0)
+}
+
+func phase_start(name string) {
+	phases_mu.Lock()
+	phases = append(phases, &manifest_phase{Name: name, Start: time.Now()})
+	phases_mu.Unlock()
+	log_main.Info("phase started", "phase", name)
+}
+
+func phase_end(name string) {
+	phases_mu.Lock()
+	for _, phase := range phases {
+		if phase.Name == name && phase.End.IsZero() {
+			phase.End = time.Now()
+		}
+	}
+	phases_mu.Unlock()
+}
+
+// version control information the binary was built with
+func scanner_version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version = setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				version += "-dirty"
+			}
+		}
+	}
+	return version
+}
+
+// the local address queries to the root server leave from, without sending anything
+func vantage_ip() string {
+	conn, err := net.Dial("udp", net.JoinHostPort(ecs.Root_server.String(), "53"))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func hash_input(key string, path string) *manifest_input {
+	input := &manifest_input{Key: key, Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return input
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		log_main.Error("hashing input", "path", path, "err", err)
+		return input
+	}
+	input.Size = size
+	input.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return input
+}
+
+func build_manifest() *run_manifest {
+	// phase_end may still be running on the shutdown path
+	phases_mu.Lock()
+	phases_copy := make([]*manifest_phase, 0, len(phases))
+	for _, phase := range phases {
+		phase_copy := *phase
+		phases_copy = append(phases_copy, &phase_copy)
+	}
+	phases_mu.Unlock()
+	manifest := &run_manifest{
+		Run_id:      cfg.Run_id,
+		Command:     run_command,
+		Round:       scan_round,
+		Args:        os.Args[1:],
+		Version:     scanner_version(),
+		Go_version:  runtime.Version(),
+		Vantage_ip:  vantage_ip(),
+		Started:     run_start,
+		Finished:    time.Now(),
+		Interrupted: interrupted(),
+		Phases:      phases_copy,
+		Counters: manifest_counters{
+			Queries_sent: stat_queries.Load(),
+			Errors:       stat_errors.Load(),
+			Rows_written: stat_rows.Load(),
+			Ns_written:   stat_ns_rows.Load(),
+		},
+		Inputs: make([]*manifest_input, 0),
+		Config: make(map[string]any),
+	}
+	for _, key := range cfg_keys() {
+		field, _ := cfg_field(key)
+		manifest.Config[key] = field.Interface()
+	}
+	// hash the input files this command used
+	inputs := []string{"blocklist_path"}
+	if cmd := get_subcommand(run_command); cmd != nil {
+		inputs = append(cmd.required, inputs...)
+	}
+	for _, key := range inputs {
+		field, ok := cfg_field(key)
+		if !ok || field.String() == "" {
+			continue
+		}
+		if _, err := os.Stat(field.String()); err != nil {
+			continue
+		}
+		manifest.Inputs = append(manifest.Inputs, hash_input(key, field.String()))
+	}
+	return manifest
+}
+
+func write_manifest() {
+	path := output_path("manifest", ".json")
+	data, err := json.MarshalIndent(build_manifest(), "", "  ")
+	if err != nil {
+		log_main.Error("building manifest", "err", err)
+		return
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		log_main.Error("writing manifest", "path", path, "err", err)
+		return
+	}
+	log_main.Info("manifest written", "path", path)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// live metrics
+// with metrics_listen set, the scanner exposes prometheus metrics on /metrics,
+// with progress_interval set, a progress line is printed to stderr periodically
+
+var (
+	metric_queries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_queries_total",
+		Help: "dns queries sent, by phase",
+	}, []string{"phase"})
+	metric_responses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_responses_total",
+		Help: "dns responses received, by phase and rcode",
+	}, []string{"phase", "rcode"})
+	metric_timeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_timeouts_total",
+		Help: "dns queries that timed out, by phase",
+	}, []string{"phase"})
+	metric_errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_errors_total",
+		Help: "dns queries that failed for other reasons than a timeout, by phase",
+	}, []string{"phase"})
+	metric_subnet_index = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_current_subnet_index",
+		Help: "index of the subnet that is currently scanned",
+	})
+)
+
+// answers of the scan, and how many of them carried an ecs option
+var ecs_answered atomic.Uint64
+var ecs_present atomic.Uint64
+
+func init() {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "ecs_scan_answers_total",
+		Help: "answers to ecs queries of the scan",
+	}, func() float64 { return float64(ecs_answered.Load()) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "ecs_scan_answers_with_ecs_total",
+		Help: "answers to ecs queries of the scan that carried an ecs option",
+	}, func() float64 { return float64(ecs_present.Load()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ecs_scan_ecs_present_ratio",
+		Help: "share of the scan answers that carried an ecs option",
+	}, func() float64 {
+		answered := ecs_answered.Load()
+		if answered == 0 {
+			return 0
+		}
+		return float64(ecs_present.Load()) / float64(answered)
+	})
+	chans := map[string]func() int{
+		"write_chan":           func() int { return len(write_chan) },
+		"write_ns_chan":        func() int { return len(write_ns_chan) },
+		"domain_chan":          pending_domains,
+		"capture_chan":         func() int { return len(capture_chan) },
+		"write_stability_chan": func() int { return len(write_stability_chan) },
+	}
+	for name, length := range chans {
+		// copied, as with go 1.21 all the closures would share the loop variable
+		length := length
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "ecs_channel_depth",
+			Help:        "number of items waiting in the channel",
+			ConstLabels: prometheus.Labels{"channel": name},
+		}, func() float64 { return float64(length()) })
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ecs_progress_ratio",
+		Help: "share of the work of the current phase that is done",
+	}, func() float64 {
+		done, total, _ := progress.state()
+		if total == 0 {
+			return 0
+		}
+		return float64(done) / float64(total)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ecs_eta_seconds",
+		Help: "estimated seconds until the current phase is done",
+	}, func() float64 {
+		return progress.eta().Seconds()
+	})
+}
+
+// maps the source of an exchange to the phase it is counted in
+var source_phases = map[string]string{
+	"resolve": "resolve-ns",
+	"ecs":     "scan-ecs",
+	"probe":   "probe-resolvers",
+}
+
+func observe_exchange(source string, rec *dns.Msg, err error) {
+	phase, ok := source_phases[source]
+	if !ok {
+		phase = source
+	}
+	metric_queries.WithLabelValues(phase).Inc()
+	var net_err net.Error
+	switch {
+	case errors.As(err, &net_err) && net_err.Timeout():
+		metric_timeouts.WithLabelValues(phase).Inc()
+	case err != nil:
+		metric_errors.WithLabelValues(phase).Inc()
+	}
+	if rec != nil {
+		metric_responses.WithLabelValues(phase, dns.RcodeToString[rec.Rcode]).Inc()
+	}
+}
+
+// progress of the currently running phase
+type phase_progress struct {
+	mu      sync.Mutex
+	phase   string
+	total   uint64
+	done    atomic.Uint64
+	started time.Time
+}
+
+var progress = &phase_progress{}
+
+// starts counting the progress of a phase that consists of total steps
+func (p *phase_progress) begin(phase string, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+	p.total = uint64(total)
+	p.done.Store(0)
+	p.started = time.Now()
+}
+
+func (p *phase_progress) step() {
+	p.done.Add(1)
+}
+
+func (p *phase_progress) state() (uint64, uint64, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done.Load(), p.total, p.started
+}
+
+func (p *phase_progress) eta() time.Duration {
+	done, total, started := p.state()
+	if done == 0 || done >= total {
+		return 0
+	}
+	elapsed := time.Since(started)
+	return time.Duration(float64(elapsed) / float64(done) * float64(total-done))
+}
+
+func (p *phase_progress) line() string {
+	done, total, started := p.state()
+	p.mu.Lock()
+	phase := p.phase
+	p.mu.Unlock()
+	if phase == "" {
+		return "waiting for the first phase"
+	}
+	percent := 0.0
+	if total != 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+	rate := float64(done) / time.Since(started).Seconds()
+	return fmt.Sprintf("[%s] %d/%d (%.1f%%) %.0f/s queries: %d errors: %d rows: %d eta: %s",
+		phase, done, total, percent, rate, stat_queries.Load(), stat_errors.Load(), stat_rows.Load(), p.eta().Round(time.Second))
+}
+
+func start_metrics() {
+	if cfg.Metrics_listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log_main.Info("serving metrics", "listen", cfg.Metrics_listen)
+			if err := http.ListenAndServe(cfg.Metrics_listen, mux); err != nil {
+				log_main.Error("metrics endpoint", "listen", cfg.Metrics_listen, "err", err)
+			}
+		}()
+	}
+	start_progress()
+}
+
+// prints the progress line until the writers are stopped
+func start_progress() {
+	if cfg.Progress_interval > 0 {
+		ctx := write_ctx
+		go func() {
+			ticker := time.NewTicker(time.Duration(cfg.Progress_interval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fmt.Fprintln(os.Stderr, progress.line())
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
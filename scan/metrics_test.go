@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the depth of every channel as the ecs_channel_depth gauges report it
+func channel_depths(t *testing.T) map[string]float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	depths := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "ecs_channel_depth" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "channel" {
+					depths[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return depths
+}
+
+func TestChannelDepth(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		write_ns_chan <- &domain_ns_pair{}
+	}
+	defer func() {
+		for len(write_ns_chan) > 0 {
+			<-write_ns_chan
+		}
+	}()
+	depths := channel_depths(t)
+	if len(depths) != 5 {
+		t.Fatalf("gauges for %d channels, want 5: %v", len(depths), depths)
+	}
+	for name, depth := range depths {
+		want := 0.0
+		if name == "write_ns_chan" {
+			want = 3
+		}
+		if depth != want {
+			t.Errorf("%s depth = %v, want %v", name, depth, want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"ecs/ecs"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquet output
+// same content as scan.csv.gz, but with typed columns so that the analysis
+// doesnt need to split the ip lists or parse the scopes
+
+type scan_row struct {
+	Timestamp       int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	Domain          string   `parquet:"name=domain, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Ns_ip           string   `parquet:"name=ns_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Subnet          string   `parquet:"name=subnet, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Returned_subnet *string  `parquet:"name=returned_subnet, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Scope           *int32   `parquet:"name=scope, type=INT32, repetitiontype=OPTIONAL"`
+	Returned_ips    []string `parquet:"name=returned_ips, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Query_id        int64    `parquet:"name=query_id, type=INT64"`
+	Rtt_ms          *float64 `parquet:"name=rtt_ms, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Source_ip       *string  `parquet:"name=source_ip, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+}
+
+func (item *scan_item) to_parquet_row() *scan_row {
+	row := &scan_row{
+		Timestamp:    item.sent_at.UnixMicro(),
+		Domain:       item.domain_ns.domain,
+		Ns_ip:        item.domain_ns.nsip.String(),
+		Subnet:       subnet_str(item.req_subnet),
+		Returned_ips: make([]string, 0, len(item.ans_ips)),
+		Query_id:     int64(item.query_id),
+		Rtt_ms:       ms_ptr(item.rtt),
+	}
+	if item.ans_subnet != nil {
+		ans_subnet := item.ans_subnet.String()
+		row.Returned_subnet = &ans_subnet
+	}
+	if item.ans_scope != nil {
+		ones, _ := item.ans_scope.Size()
+		scope := int32(ones)
+		row.Scope = &scope
+	}
+	for _, ip := range item.ans_ips {
+		row.Returned_ips = append(row.Returned_ips, ip.String())
+	}
+	if item.source != nil {
+		source := item.source.String()
+		row.Source_ip = &source
+	}
+	return row
+}
+
+type ns_row struct {
+	Domain     string   `parquet:"name=domain, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Ns_ip      string   `parquet:"name=ns_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Resolve_ms float64  `parquet:"name=resolve_ms, type=DOUBLE"`
+	Ns_rtt_ms  *float64 `parquet:"name=ns_rtt_ms, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+// the answer sets as in the csv (ips separated by commas), their counts at the same index
+type stability_row struct {
+	Domain      string   `parquet:"name=domain, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Ns_ip       string   `parquet:"name=ns_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Subnet      string   `parquet:"name=subnet, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Queries     int32    `parquet:"name=queries, type=INT32"`
+	Answered    int32    `parquet:"name=answered, type=INT32"`
+	Answer_sets []string `parquet:"name=answer_sets, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Set_counts  []int32  `parquet:"name=set_counts, type=LIST, valuetype=INT32"`
+	Stability   float64  `parquet:"name=stability, type=DOUBLE"`
+}
+
+func stability_to_parquet_row(stability *ecs.Stability) *stability_row {
+	row := &stability_row{
+		Domain:      stability.Domain,
+		Ns_ip:       stability.Nameserver.String(),
+		Subnet:      subnet_str(stability.Subnet),
+		Queries:     int32(stability.Queries),
+		Answered:    int32(stability.Answered),
+		Answer_sets: make([]string, 0, len(stability.Answer_sets)),
+		Set_counts:  make([]int32, 0, len(stability.Answer_sets)),
+		Stability:   stability.Score,
+	}
+	for _, set := range stability.Answer_sets {
+		row.Answer_sets = append(row.Answer_sets, strings.Join(set.Answers, ","))
+		row.Set_counts = append(row.Set_counts, int32(set.Count))
+	}
+	return row
+}
+
+// parquet file, created on the first write
+type parquet_file struct {
+	path      string
+	schema    any
+	file      *os.File
+	pq_writer *writer.ParquetWriter
+}
+
+func (f *parquet_file) write(row any) error {
+	if f.pq_writer == nil {
+		file, err := os.Create(f.path)
+		if err != nil {
+			return err
+		}
+		pq_writer, err := writer.NewParquetWriterFromWriter(file, f.schema, 4)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		log_writer.Info("writing to file", "path", f.path)
+		f.file = file
+		f.pq_writer = pq_writer
+	}
+	return f.pq_writer.Write(row)
+}
+
+func (f *parquet_file) close() error {
+	if f.pq_writer == nil {
+		return nil
+	}
+	return errors.Join(f.pq_writer.WriteStop(), f.file.Close())
+}
+
+type parquet_sink struct {
+	items                *parquet_file
+	baselines            *parquet_file
+	nss                  *parquet_file
+	stabilities          *parquet_file
+	baseline_stabilities *parquet_file
+}
+
+func new_parquet_sink(items_path string, baselines_path string, nss_path string, stabilities_path string, baseline_stabilities_path string) *parquet_sink {
+	return &parquet_sink{
+		items:                &parquet_file{path: items_path, schema: new(scan_row)},
+		baselines:            &parquet_file{path: baselines_path, schema: new(scan_row)},
+		nss:                  &parquet_file{path: nss_path, schema: new(ns_row)},
+		stabilities:          &parquet_file{path: stabilities_path, schema: new(stability_row)},
+		baseline_stabilities: &parquet_file{path: baseline_stabilities_path, schema: new(stability_row)},
+	}
+}
+
+func (s *parquet_sink) write_item(item *scan_item) error {
+	if item.baseline {
+		return s.baselines.write(item.to_parquet_row())
+	}
+	return s.items.write(item.to_parquet_row())
+}
+
+func (s *parquet_sink) write_ns(pair *domain_ns_pair) error {
+	return s.nss.write(&ns_row{
+		Domain:     pair.domain,
+		Ns_ip:      pair.nsip.String(),
+		Resolve_ms: float64(pair.resolve_duration.Microseconds()) / 1000,
+		Ns_rtt_ms:  ms_ptr(pair.ns_rtt),
+	})
+}
+
+func (s *parquet_sink) write_stability(stability *ecs.Stability) error {
+	if stability.Baseline {
+		return s.baseline_stabilities.write(stability_to_parquet_row(stability))
+	}
+	return s.stabilities.write(stability_to_parquet_row(stability))
+}
+
+func (s *parquet_sink) close() error {
+	return errors.Join(s.items.close(), s.baselines.close(), s.nss.close(), s.stabilities.close(), s.baseline_stabilities.close())
+}
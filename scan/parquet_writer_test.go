@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func read_parquet[T any](t *testing.T, path string) []T {
+	t.Helper()
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pq_reader, err := reader.NewParquetReader(file, new(T), 1)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	defer pq_reader.ReadStop()
+	rows := make([]T, pq_reader.GetNumRows())
+	if err := pq_reader.Read(&rows); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return rows
+}
+
+// the rows written by the parquet sink are read back with their types
+func TestParquetRoundTrip(t *testing.T) {
+	default_config(t)
+	cfg.Output_dir = t.TempDir()
+	item, baseline, pair, stability := test_records(t)
+	baseline_stability := *stability
+	baseline_stability.Subnet = nil
+	baseline_stability.Baseline = true
+
+	// through the multi sink, which passes every record on to all the sinks
+	out, err := new_multi_sink([]string{"parquet", "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := func(kind string) string {
+		return output_path(kind, ".parquet")
+	}
+	if _, err := os.Stat(path("scan")); err == nil {
+		t.Error("file created before the first record")
+	}
+	for _, err := range []error{out.write_item(item), out.write_item(baseline), out.write_ns(pair), out.write_stability(stability),
+		out.write_stability(&baseline_stability), out.close()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(cfg.Output_dir, "*")); len(matches) != 10 {
+		t.Errorf("files %v, want one per kind and sink", matches)
+	}
+
+	check_records(t, path("scan"), read_parquet[scan_row](t, path("scan")), *item.to_parquet_row())
+	check_records(t, path("baseline"), read_parquet[scan_row](t, path("baseline")), *baseline.to_parquet_row())
+	check_records(t, path("nameserver"), read_parquet[ns_row](t, path("nameserver")),
+		ns_row{Domain: "example.com", Ns_ip: "192.0.2.53", Resolve_ms: 42.1, Ns_rtt_ms: ms_ptr(7 * time.Millisecond)})
+	check_records(t, path("stability"), read_parquet[stability_row](t, path("stability")), *stability_to_parquet_row(stability))
+	check_records(t, path("baseline_stability"), read_parquet[stability_row](t, path("baseline_stability")), *stability_to_parquet_row(&baseline_stability))
+
+	got := read_parquet[scan_row](t, path("scan"))[0]
+	if got.Timestamp != item.sent_at.UnixMicro() || got.Scope == nil || *got.Scope != 20 || len(got.Returned_ips) != 2 {
+		t.Errorf("scan row %+v", got)
+	}
+	if got := read_parquet[scan_row](t, path("baseline"))[0]; got.Subnet != "" || got.Scope != nil || got.Rtt_ms != nil || got.Returned_subnet != nil {
+		t.Errorf("baseline row %+v", got)
+	}
+}
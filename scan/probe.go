@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// single domain probe
+// meant for debugging surprising rows of scan.csv.gz: the domain is resolved with
+// the full trace printed, then its nameserver is queried with every given subnet
+// and the results are put next to each other
+
+func ip_strs(ips []net.IP) []string {
+	strs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	slices.Sort(strs)
+	return slices.Compact(strs)
+}
+
+// what has been added (+) and removed (-) compared to the reference answers
+func diff_answers(reference []string, answers []string) string {
+	diff := make([]string, 0)
+	for _, ip := range answers {
+		if !slices.Contains(reference, ip) {
+			diff = append(diff, "+"+ip)
+		}
+	}
+	for _, ip := range reference {
+		if !slices.Contains(answers, ip) {
+			diff = append(diff, "-"+ip)
+		}
+	}
+	if len(diff) == 0 {
+		return "="
+	}
+	return strings.Join(diff, " ")
+}
+
+func (item *scan_item) echo_state() string {
+	if item.ans_subnet == nil {
+		return "none"
+	}
+	if item.ans_subnet.String() == item.req_subnet.String() {
+		return "match"
+	}
+	return "mismatch"
+}
+
+func print_probe_table(results []*scan_item) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "QID\tSUBNET\tECHO\tRETURNED-SUBNET\tSCOPE\tRTT\tANSWERS\tDIFF")
+	var reference []string = nil
+	answer_sets := make(map[string]bool)
+	for _, result := range results {
+		answers := ip_strs(result.ans_ips)
+		answer_sets[strings.Join(answers, ",")] = true
+		ans_subnet := "-"
+		if result.ans_subnet != nil {
+			ans_subnet = result.ans_subnet.String()
+		}
+		scope := "-"
+		if result.ans_scope != nil {
+			ones, _ := result.ans_scope.Size()
+			scope = strconv.Itoa(ones)
+		}
+		// the first subnet is the reference all the others are compared to
+		diff := "(reference)"
+		if reference == nil {
+			reference = answers
+		} else {
+			diff = diff_answers(reference, answers)
+		}
+		rtt := "-"
+		if result.rtt != 0 {
+			rtt = ms_str(result.rtt) + "ms"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", result.query_id, result.req_subnet, result.echo_state(), ans_subnet, scope, rtt, strings.Join(answers, ","), diff)
+	}
+	w.Flush()
+	fmt.Println(len(answer_sets), "distinct answer set(s) for", len(results), "subnet(s)")
+}
+
+func cmd_probe(args []string) error {
+	fs := new_flag_set("probe", "<domain> <subnet>...")
+	load := cfg_flags(fs)
+	no_trace := fs.Bool("no-trace", false, "do not print the resolution trace")
+	ns_str := fs.String("ns", "", "query this nameserver instead of resolving it")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return fmt.Errorf("probe needs a domain and at least one subnet")
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	domain := strings.TrimSuffix(fs.Arg(0), ".")
+	probe_subnets := make([]*net.IPNet, 0)
+	for _, subnet_str := range fs.Args()[1:] {
+		_, subnet, err := net.ParseCIDR(subnet_str)
+		if err != nil {
+			return err
+		}
+		probe_subnets = append(probe_subnets, subnet)
+	}
+	exclude_ips()
+	if err := setup_scanner(); err != nil {
+		return err
+	}
+	start_capture()
+	defer close_writers()
+
+	var nsip net.IP = nil
+	if *ns_str != "" {
+		nsip = net.ParseIP(*ns_str)
+		if nsip == nil {
+			return fmt.Errorf("invalid nameserver ip %s", *ns_str)
+		}
+	} else {
+		if !*no_trace {
+			fmt.Println("=== resolving", domain, "===")
+			resolver.Trace = os.Stdout
+		}
+		t_start := time.Now()
+		var answers []net.IP
+		answers, nsip, _ = resolver.Resolve(run_ctx, domain)
+		resolver.Trace = nil
+		if nsip == nil {
+			return fmt.Errorf("could not resolve a nameserver for %s", domain)
+		}
+		fmt.Println("answers without ecs:", strings.Join(ip_strs(answers), ","), "resolved in", time.Since(t_start).Round(time.Microsecond))
+	}
+	fmt.Println("=== querying", nsip, "for", domain, "with", len(probe_subnets), "subnet(s) ===")
+
+	results := make([]*scan_item, 0, len(probe_subnets))
+	for _, subnet := range probe_subnets {
+		results = append(results, result_item(prober.Probe(run_ctx, domain, nsip, subnet)))
+	}
+	print_probe_table(results)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	http_pprof "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+)
+
+// profiling
+// profiles lists the profiles written to profile_dir for every phase: cpu covers the
+// whole phase, heap, goroutine, mutex and block are snapshots taken at its end
+// mutex and block make the runtime record contention, e.g. on the cache tree and the writer
+// channels, which costs some performance, so they are off unless asked for
+// with pprof_listen set, all profiles can also be fetched live from /debug/pprof/
+
+var profile_names = []string{"cpu", "heap", "goroutine", "mutex", "block"}
+
+func profile_enabled(name string) bool {
+	return slices.Contains(cfg.Profiles, name)
+}
+
+func validate_profiles(names []string) error {
+	errs := make([]error, 0)
+	for _, name := range names {
+		if !slices.Contains(profile_names, name) {
+			errs = append(errs, fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(profile_names, ",")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sets up the contention profiling and the live endpoint
+func start_profiling() {
+	if profile_enabled("block") {
+		runtime.SetBlockProfileRate(cfg.Block_profile_rate)
+	}
+	if profile_enabled("mutex") {
+		runtime.SetMutexProfileFraction(cfg.Mutex_profile_fraction)
+	}
+	if cfg.Pprof_listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", http_pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", http_pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", http_pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", http_pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", http_pprof.Trace)
+	go func() {
+		log_main.Info("serving pprof", "listen", cfg.Pprof_listen)
+		if err := http.ListenAndServe(cfg.Pprof_listen, mux); err != nil {
+			log_main.Error("pprof endpoint", "listen", cfg.Pprof_listen, "err", err)
+		}
+	}()
+}
+
+func profile_path(name string, phase string) string {
+	return filepath.Join(cfg.Profile_dir, name+"_"+phase+".prof")
+}
+
+// starts the profiles of a phase, the returned function ends them
+func profile_phase(phase string) func() {
+	if len(cfg.Profiles) == 0 {
+		return func() {}
+	}
+	if err := os.MkdirAll(cfg.Profile_dir, 0755); err != nil {
+		log_main.Error("creating profile_dir", "path", cfg.Profile_dir, "err", err)
+		return func() {}
+	}
+	var cpu_file *os.File = nil
+	if profile_enabled("cpu") {
+		file, err := os.Create(profile_path("cpu", phase))
+		if err != nil {
+			log_main.Error("creating cpu profile", "phase", phase, "err", err)
+		} else if err := pprof.StartCPUProfile(file); err != nil {
+			log_main.Error("starting cpu profile", "phase", phase, "err", err)
+			file.Close()
+		} else {
+			cpu_file = file
+		}
+	}
+	return func() {
+		if cpu_file != nil {
+			pprof.StopCPUProfile()
+			cpu_file.Close()
+			log_main.Info("profile written", "phase", phase, "path", cpu_file.Name())
+		}
+		for _, name := range cfg.Profiles {
+			if name == "cpu" {
+				continue
+			}
+			write_profile(name, phase)
+		}
+	}
+}
+
+func write_profile(name string, phase string) {
+	path := profile_path(name, phase)
+	file, err := os.Create(path)
+	if err != nil {
+		log_main.Error("creating profile", "profile", name, "phase", phase, "err", err)
+		return
+	}
+	defer file.Close()
+	if name == "heap" {
+		runtime.GC() // up to date statistics
+	}
+	if err := pprof.Lookup(name).WriteTo(file, 0); err != nil {
+		log_main.Error("writing profile", "profile", name, "phase", phase, "err", err)
+		return
+	}
+	log_main.Info("profile written", "phase", phase, "path", path)
+}
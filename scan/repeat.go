@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// longitudinal scans
+// repeat runs the ecs phase every round_interval seconds (start to start), rounds
+// times or until it is stopped, and resolves the nameservers again every
+// resolve_every rounds. every round writes its files, manifest included, to its own
+// directory round_<n> in output_dir, so that two rounds can be compared with diff
+
+// the round of repeat that is running, 0 for the other subcommands
+var scan_round = 0
+
+// points the output to the directory of round and starts its writers
+func start_round(round int, base_dir string) {
+	scan_round = round
+	cfg.Output_dir = filepath.Join(base_dir, fmt.Sprintf("round_%04d", round))
+	run_start = time.Now()
+	reset_stats()
+	reset_completed()
+	reset_writers()
+	start_writer(writeout)
+	start_capture()
+	log_main.Info("round started", "round", round, "output_dir", cfg.Output_dir)
+}
+
+func run_rounds() {
+	base_dir := cfg.Output_dir
+	interval := time.Duration(cfg.Round_interval) * time.Second
+	for round := 1; cfg.Rounds == 0 || round <= cfg.Rounds; round++ {
+		round_start := time.Now()
+		start_round(round, base_dir)
+		if round == 1 {
+			start_metrics()
+			start_profiling()
+		} else {
+			start_progress()
+		}
+		if (round-1)%cfg.Resolve_every == 0 {
+			run_ns_phase()
+		} else {
+			log_main.Info("reusing the nameservers", "round", round, "nameservers", len(domains))
+		}
+		if !interrupted() {
+			run_ecs_phase()
+		}
+		finish_run()
+		log_main.Info("round done", "round", round, "took", time.Since(round_start))
+		if interrupted() || round == cfg.Rounds {
+			break
+		}
+		next := round_start.Add(interval)
+		if wait := time.Until(next); wait > 0 {
+			log_main.Info("waiting for the next round", "round", round+1, "at", next)
+			sleep_ctx(run_ctx, wait)
+		} else {
+			log_main.Warn("round took longer than round_interval, starting the next one right away", "round", round, "round_interval", cfg.Round_interval)
+		}
+		if interrupted() {
+			break
+		}
+	}
+	log_main.Info("program end")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ecs support report
+// streams scan files and classifies every nameserver and every domain by the ecs
+// support of its answers:
+//
+//	unanswered  not a single answer
+//	no_ecs      answers, but never with an ecs option
+//	scope_zero  ecs options, but always with scope 0, i.e. the answer is not tailored
+//	tailored    at least one ecs option with a scope above 0
+//
+// an echo mismatch is an ecs option whose subnet differs from the one that was sent
+
+var report_classes = []string{"unanswered", "no_ecs", "scope_zero", "tailored"}
+var report_formats = []string{"markdown", "csv", "json"}
+
+type report_counts struct {
+	queries       int
+	answered      int
+	with_ecs      int
+	scope_nonzero int
+	echo_mismatch int
+	scopes        map[int]int
+}
+
+func (counts *report_counts) add(records []string) {
+	counts.queries++
+	// the rtt is only set with a response, older files without it fall back to the answers
+	if records[4] != "" || records[6] != "" || len(records) > 8 && records[8] != "" {
+		counts.answered++
+	}
+	if records[4] == "" {
+		return
+	}
+	counts.with_ecs++
+	if records[3] != "" && records[4] != records[3] {
+		counts.echo_mismatch++
+	}
+	if scope, err := strconv.Atoi(records[5]); err == nil {
+		counts.scopes[scope]++
+		if scope > 0 {
+			counts.scope_nonzero++
+		}
+	}
+}
+
+func (counts *report_counts) class() string {
+	switch {
+	case counts.answered == 0:
+		return "unanswered"
+	case counts.with_ecs == 0:
+		return "no_ecs"
+	case counts.scope_nonzero == 0:
+		return "scope_zero"
+	}
+	return "tailored"
+}
+
+// scope:count pairs by ascending scope
+func (counts *report_counts) scopes_str() string {
+	scopes := make([]int, 0, len(counts.scopes))
+	for scope := range counts.scopes {
+		scopes = append(scopes, scope)
+	}
+	slices.Sort(scopes)
+	pairs := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		pairs = append(pairs, fmt.Sprintf("%d:%d", scope, counts.scopes[scope]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func new_report_counts() *report_counts {
+	return &report_counts{scopes: make(map[int]int)}
+}
+
+type ecs_report struct {
+	total       *report_counts
+	nameservers map[string]*report_counts
+	domains     map[string]*report_counts
+	domain_nss  map[string]map[string]bool
+}
+
+func new_ecs_report() *ecs_report {
+	return &ecs_report{
+		total:       new_report_counts(),
+		nameservers: make(map[string]*report_counts),
+		domains:     make(map[string]*report_counts),
+		domain_nss:  make(map[string]map[string]bool),
+	}
+}
+
+func (report *ecs_report) add(records []string) {
+	domain, nameserver := records[1], records[2]
+	if _, ok := report.nameservers[nameserver]; !ok {
+		report.nameservers[nameserver] = new_report_counts()
+	}
+	if _, ok := report.domains[domain]; !ok {
+		report.domains[domain] = new_report_counts()
+		report.domain_nss[domain] = make(map[string]bool)
+	}
+	report.total.add(records)
+	report.nameservers[nameserver].add(records)
+	report.domains[domain].add(records)
+	report.domain_nss[domain][nameserver] = true
+}
+
+// streams a scan.csv.gz into report
+func (report *ecs_report) read(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zip_reader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer zip_reader.Close()
+
+	csv_reader := csv.NewReader(zip_reader)
+	csv_reader.Comma = ';'
+	csv_reader.FieldsPerRecord = -1
+	csv_reader.ReuseRecord = true
+	for {
+		records, err := csv_reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if len(records) < 7 {
+			line, _ := csv_reader.FieldPos(0)
+			return fmt.Errorf("%s:%d: expected at least 7 fields, got %d", path, line, len(records))
+		}
+		report.add(records)
+	}
+}
+
+// a table of the report, the cells are strings or ints
+type report_table struct {
+	name   string
+	header []string
+	rows   [][]any
+}
+
+var counts_header = []string{"queries", "answered", "with_ecs", "echo_mismatch"}
+
+func (counts *report_counts) cells() []any {
+	return []any{counts.queries, counts.answered, counts.with_ecs, counts.echo_mismatch}
+}
+
+// keys of counts, most queried first
+func by_queries(counts map[string]*report_counts) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a string, b string) int {
+		if counts[a].queries != counts[b].queries {
+			return counts[b].queries - counts[a].queries
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
+
+// the nameserver and domain tables are cut to limit rows, 0 for all
+func (report *ecs_report) tables(limit int) []*report_table {
+	summary := &report_table{name: "summary", header: []string{"class", "nameservers", "domains"}}
+	ns_classes := make(map[string]int)
+	for _, counts := range report.nameservers {
+		ns_classes[counts.class()]++
+	}
+	domain_classes := make(map[string]int)
+	for _, counts := range report.domains {
+		domain_classes[counts.class()]++
+	}
+	for _, class := range report_classes {
+		summary.rows = append(summary.rows, []any{class, ns_classes[class], domain_classes[class]})
+	}
+	summary.rows = append(summary.rows, []any{"total", len(report.nameservers), len(report.domains)})
+
+	totals := &report_table{name: "totals", header: counts_header}
+	totals.rows = append(totals.rows, report.total.cells())
+
+	scopes := &report_table{name: "scopes", header: []string{"scope", "answers", "nameservers", "domains"}}
+	ns_scopes := make(map[int]int)
+	for _, counts := range report.nameservers {
+		for scope := range counts.scopes {
+			ns_scopes[scope]++
+		}
+	}
+	domain_scopes := make(map[int]int)
+	for _, counts := range report.domains {
+		for scope := range counts.scopes {
+			domain_scopes[scope]++
+		}
+	}
+	scope_values := make([]int, 0, len(report.total.scopes))
+	for scope := range report.total.scopes {
+		scope_values = append(scope_values, scope)
+	}
+	slices.Sort(scope_values)
+	for _, scope := range scope_values {
+		scopes.rows = append(scopes.rows, []any{scope, report.total.scopes[scope], ns_scopes[scope], domain_scopes[scope]})
+	}
+
+	nameservers := &report_table{name: "nameservers",
+		header: append([]string{"nameserver", "class", "domains"}, append(counts_header, "scopes")...)}
+	ns_domains := make(map[string]int)
+	for _, nss := range report.domain_nss {
+		for ns := range nss {
+			ns_domains[ns]++
+		}
+	}
+	for i, ns := range by_queries(report.nameservers) {
+		if limit > 0 && i == limit {
+			break
+		}
+		counts := report.nameservers[ns]
+		row := append([]any{ns, counts.class(), ns_domains[ns]}, counts.cells()...)
+		nameservers.rows = append(nameservers.rows, append(row, counts.scopes_str()))
+	}
+
+	domains := &report_table{name: "domains",
+		header: append([]string{"domain", "class", "nameservers"}, append(counts_header, "scopes")...)}
+	for i, domain := range by_queries(report.domains) {
+		if limit > 0 && i == limit {
+			break
+		}
+		counts := report.domains[domain]
+		row := append([]any{domain, counts.class(), len(report.domain_nss[domain])}, counts.cells()...)
+		domains.rows = append(domains.rows, append(row, counts.scopes_str()))
+	}
+	return []*report_table{summary, totals, scopes, nameservers, domains}
+}
+
+func write_table_markdown(w io.Writer, table *report_table) {
+	fmt.Fprintf(w, "## %s\n\n", table.name)
+	fmt.Fprintf(w, "| %s |\n", strings.Join(table.header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(table.header)))
+	for _, row := range table.rows {
+		cells := make([]string, 0, len(row))
+		for _, cell := range row {
+			cells = append(cells, fmt.Sprint(cell))
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+	fmt.Fprintln(w)
+}
+
+// unlike the scan files, the tables carry a header line
+func write_table_csv(w io.Writer, table *report_table) error {
+	csv_writer := csv.NewWriter(w)
+	csv_writer.Comma = ';'
+	csv_writer.Write(table.header)
+	for _, row := range table.rows {
+		cells := make([]string, 0, len(row))
+		for _, cell := range row {
+			cells = append(cells, fmt.Sprint(cell))
+		}
+		csv_writer.Write(cells)
+	}
+	csv_writer.Flush()
+	return csv_writer.Error()
+}
+
+// all tables as one object, every table as a list of objects keyed by the header
+func write_tables_json(w io.Writer, tables []*report_table) error {
+	doc := make(map[string][]map[string]any)
+	for _, table := range tables {
+		rows := make([]map[string]any, 0, len(table.rows))
+		for _, row := range table.rows {
+			object := make(map[string]any)
+			for i, cell := range row {
+				object[table.header[i]] = cell
+			}
+			rows = append(rows, object)
+		}
+		doc[table.name] = rows
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// writes the tables to stdout, or with out set to out.md, out.json or one
+// out_<table>.csv per table
+func write_report(tables []*report_table, format string, out string) error {
+	if format == "csv" && out != "" {
+		for _, table := range tables {
+			path := out + "_" + table.name + ".csv"
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			err = errors.Join(write_table_csv(file, table), file.Close())
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "report written to", path)
+		}
+		return nil
+	}
+	var w io.Writer = os.Stdout
+	if out != "" {
+		ext := map[string]string{"markdown": ".md", "json": ".json"}[format]
+		file, err := os.Create(out + ext)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		defer fmt.Fprintln(os.Stderr, "report written to", out+ext)
+		w = file
+	}
+	switch format {
+	case "json":
+		return write_tables_json(w, tables)
+	case "csv":
+		for i, table := range tables {
+			if i != 0 {
+				fmt.Fprintln(w)
+			}
+			if err := write_table_csv(w, table); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, table := range tables {
+		write_table_markdown(w, table)
+	}
+	return nil
+}
+
+func cmd_report(args []string) error {
+	fs := new_flag_set("report", "<scan.csv.gz>...")
+	format := fs.String("format", "markdown", "output format: "+strings.Join(report_formats, ", "))
+	out := fs.String("out", "", "write the report to this path (without extension) instead of stdout")
+	limit := fs.Int("limit", 0, "rows of the nameserver and domain tables, most queried first, 0 for all")
+	fs.Parse(args)
+	if !slices.Contains(report_formats, *format) {
+		return fmt.Errorf("unknown format %q, expected one of %s", *format, strings.Join(report_formats, ","))
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("report needs at least one scan file")
+	}
+	report := new_ecs_report()
+	for _, path := range fs.Args() {
+		if err := report.read(path); err != nil {
+			return err
+		}
+	}
+	return write_report(report.tables(*limit), *format, *out)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a scan row of domain, nameserver, subnet, returned subnet, scope, answers and rtt
+func report_row(domain string, nameserver string, ans_subnet string, scope string, ips string, rtt string) []string {
+	return []string{"2026-01-01 00:00:00.000000", domain, nameserver, "203.0.113.0/24", ans_subnet, scope, ips, "1", rtt, ""}
+}
+
+func TestReportCounts(t *testing.T) {
+	const subnet = "203.0.113.0/24"
+	tests := []struct {
+		name   string
+		rows   [][]string
+		class  string
+		counts report_counts
+	}{
+		{"unanswered", [][]string{report_row("a.test", "192.0.2.1", "", "", "", ""), report_row("a.test", "192.0.2.1", "", "", "", "")},
+			"unanswered", report_counts{queries: 2, scopes: map[int]int{}}},
+		{"no ecs", [][]string{report_row("a.test", "192.0.2.1", "", "", "198.51.100.1", "10.000"), report_row("a.test", "192.0.2.1", "", "", "", "")},
+			"no_ecs", report_counts{queries: 2, answered: 1, scopes: map[int]int{}}},
+		// an empty answer, only the rtt tells that there was one
+		{"empty answer", [][]string{report_row("a.test", "192.0.2.1", "", "", "", "10.000")},
+			"no_ecs", report_counts{queries: 1, answered: 1, scopes: map[int]int{}}},
+		// older files without the rtt column
+		{"without rtt", [][]string{report_row("a.test", "192.0.2.1", "", "", "198.51.100.1", "")[:7]},
+			"no_ecs", report_counts{queries: 1, answered: 1, scopes: map[int]int{}}},
+		{"scope zero", [][]string{report_row("a.test", "192.0.2.1", subnet, "0", "198.51.100.1", "10.000"), report_row("a.test", "192.0.2.1", subnet, "0", "198.51.100.1", "10.000")},
+			"scope_zero", report_counts{queries: 2, answered: 2, with_ecs: 2, scopes: map[int]int{0: 2}}},
+		{"tailored", [][]string{report_row("a.test", "192.0.2.1", subnet, "0", "198.51.100.1", "10.000"), report_row("a.test", "192.0.2.1", subnet, "24", "198.51.100.2", "10.000"),
+			report_row("a.test", "192.0.2.1", "", "", "", "")},
+			"tailored", report_counts{queries: 3, answered: 2, with_ecs: 2, scope_nonzero: 1, scopes: map[int]int{0: 1, 24: 1}}},
+		{"echo mismatch", [][]string{report_row("a.test", "192.0.2.1", "203.0.0.0/16", "16", "198.51.100.1", "10.000")},
+			"tailored", report_counts{queries: 1, answered: 1, with_ecs: 1, scope_nonzero: 1, echo_mismatch: 1, scopes: map[int]int{16: 1}}},
+		{"unparsable scope", [][]string{report_row("a.test", "192.0.2.1", subnet, "", "198.51.100.1", "10.000")},
+			"scope_zero", report_counts{queries: 1, answered: 1, with_ecs: 1, scopes: map[int]int{}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counts := new_report_counts()
+			for _, row := range test.rows {
+				counts.add(row)
+			}
+			if !reflect.DeepEqual(*counts, test.counts) {
+				t.Errorf("counts %+v, want %+v", *counts, test.counts)
+			}
+			if class := counts.class(); class != test.class {
+				t.Errorf("class %s, want %s", class, test.class)
+			}
+		})
+	}
+}
+
+// the summary counts every nameserver and domain in the bucket of its class
+func TestReportSummary(t *testing.T) {
+	const subnet = "203.0.113.0/24"
+	report := new_ecs_report()
+	for _, row := range [][]string{
+		report_row("unanswered.test", "192.0.2.1", "", "", "", ""),
+		report_row("no-ecs.test", "192.0.2.2", "", "", "198.51.100.2", "10.000"),
+		report_row("scope-zero.test", "192.0.2.3", subnet, "0", "198.51.100.3", "10.000"),
+		report_row("tailored.test", "192.0.2.4", subnet, "24", "198.51.100.4", "10.000"),
+		// the domain is tailored by its second nameserver, which is scope_zero on its own
+		report_row("mixed.test", "192.0.2.3", subnet, "0", "198.51.100.3", "10.000"),
+		report_row("mixed.test", "192.0.2.4", subnet, "24", "198.51.100.4", "10.000"),
+	} {
+		report.add(row)
+	}
+	summary := report.tables(0)[0]
+	want := [][]any{
+		{"unanswered", 1, 1},
+		{"no_ecs", 1, 1},
+		{"scope_zero", 1, 1},
+		{"tailored", 1, 2},
+		{"total", 4, 5},
+	}
+	if summary.name != "summary" || !reflect.DeepEqual(summary.rows, want) {
+		t.Errorf("%s rows %v, want %v", summary.name, summary.rows, want)
+	}
+	if report.total.queries != 6 || report.nameservers["192.0.2.3"].queries != 2 || report.domains["mixed.test"].queries != 2 {
+		t.Errorf("total %+v, 192.0.2.3 %+v, mixed.test %+v", report.total, report.nameservers["192.0.2.3"], report.domains["mixed.test"])
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"ecs/ecs"
+
+	"github.com/miekg/dns"
+)
+
+// resolver probing
+// instead of asking the authoritative nameservers directly we send the ecs queries
+// to recursive resolvers for names below a zone we control. the authoritative of that
+// zone echoes whatever ecs option it received from the resolver in a TXT answer:
+//
+//	"ecs=<family>/<address>/<source-prefix>" or "ecs=none"
+//	"src=<ip of the querying resolver>"
+//	"ts=<unix nanoseconds when the query was received>"
+//
+// by comparing the subnet we sent with the one the authoritative saw, we can tell what
+// the resolver did with our client subnet
+
+const (
+	ECS_FORWARDED = "forwarded" // passed on unchanged
+	ECS_TRUNCATED = "truncated" // same network, but shortened prefix
+	ECS_REPLACED  = "replaced"  // a different subnet arrived at the authoritative
+	ECS_STRIPPED  = "stripped"  // no ecs option arrived at the authoritative
+	ECS_NO_ANSWER = "no-answer" // resolver didnt respond or the answer carried no echo
+)
+
+type resolver_target struct {
+	ip   net.IP
+	addr string // ip:port
+}
+
+type echo_record struct {
+	ecs_family uint16
+	ecs_subnet *net.IPNet // nil if the authoritative saw no ecs
+	src_ip     net.IP
+	timestamp  time.Time
+}
+
+type probe_item struct {
+	resolver   *resolver_target
+	qname      string
+	req_subnet *net.IPNet
+	echo       *echo_record
+	class      string
+	ans_subnet *net.IPNet
+	ans_scope  net.IPMask
+	query_id   uint64
+	sent_at    time.Time
+}
+
+type probe_job struct {
+	resolver  *resolver_target
+	subnet    *net.IPNet
+	remaining *atomic.Int64 // probes of the subnet that are not written yet
+}
+
+var resolvers = make([]*resolver_target, 0)
+var write_probe_chan = make(chan *probe_item, 4096)
+
+// the csv format will be as follows:
+// timestamp;resolver-ip;qname;req-subnet-cidr;[seen-subnet-cidr];[seen-prefix];classification;[ans-subnet-cidr];[ans-scope];[seen-src-ip];query-id;[seen-family];[seen-at]
+// seen-family is the ecs family the authoritative got (1 ipv4, 2 ipv6), seen-at the time it received the query
+func (item *probe_item) to_csv_strarr() []string {
+	ret_str := make([]string, 13)
+	ret_str[0] = item.sent_at.Format("2006-01-02 15:04:05.000000")
+	ret_str[1] = item.resolver.addr
+	ret_str[2] = item.qname
+	ret_str[3] = item.req_subnet.String()
+	if item.echo != nil && item.echo.ecs_subnet != nil {
+		ret_str[4] = item.echo.ecs_subnet.String()
+		ones, _ := item.echo.ecs_subnet.Mask.Size()
+		ret_str[5] = strconv.Itoa(ones)
+	}
+	ret_str[6] = item.class
+	if item.ans_subnet != nil {
+		ret_str[7] = item.ans_subnet.String()
+	}
+	if item.ans_scope != nil {
+		ones, _ := item.ans_scope.Size()
+		ret_str[8] = strconv.Itoa(ones)
+	}
+	if item.echo != nil && item.echo.src_ip != nil {
+		ret_str[9] = item.echo.src_ip.String()
+	}
+	ret_str[10] = strconv.FormatUint(item.query_id, 10)
+	if item.echo != nil && item.echo.ecs_subnet != nil {
+		ret_str[11] = strconv.Itoa(int(item.echo.ecs_family))
+	}
+	if item.echo != nil && !item.echo.timestamp.IsZero() {
+		ret_str[12] = item.echo.timestamp.Format("2006-01-02 15:04:05.000000")
+	}
+	return ret_str
+}
+
+func writeout_probe(ctx context.Context) {
+	if err := os.MkdirAll(cfg.Output_dir, 0755); err != nil {
+		panic(err)
+	}
+	csvfile, err := os.Create(output_path("resolver", ".csv.gz"))
+	if err != nil {
+		panic(err)
+	}
+	defer csvfile.Close()
+
+	zip_writer := gzip.NewWriter(csvfile)
+	defer zip_writer.Close()
+
+	writer := csv.NewWriter(zip_writer)
+	writer.Comma = ';'
+	defer writer.Flush()
+
+	write := func(item *probe_item) {
+		out_str := item.to_csv_strarr()
+		log_writer.Debug("writing probe item", "row", out_str)
+		if err := writer.Write(out_str); err == nil {
+			stat_rows.Add(1)
+		}
+	}
+	for {
+		select {
+		case item := <-write_probe_chan:
+			write(item)
+		case <-ctx.Done():
+			// write what is still waiting in the channel
+			for {
+				select {
+				case item := <-write_probe_chan:
+					write(item)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// parses one entry of the resolver list, either "ip" or "ip:port"
+func parse_resolver(entry string) *resolver_target {
+	if ip := net.ParseIP(entry); ip != nil {
+		return &resolver_target{ip: ip, addr: net.JoinHostPort(ip.String(), "53")}
+	}
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	return &resolver_target{ip: ip, addr: net.JoinHostPort(ip.String(), port)}
+}
+
+func read_resolvers() {
+	log_main.Info("reading resolvers", "path", cfg.Resolvers_fname)
+	file, err := os.Open(cfg.Resolvers_fname)
+	if err != nil {
+		fatal("unable to read input file", "path", cfg.Resolvers_fname, "err", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		comment_pos := strings.IndexByte(line, '#')
+		if comment_pos != -1 {
+			line = line[:comment_pos]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		target := parse_resolver(line)
+		if target == nil {
+			fatal("invalid resolver entry", "entry", line)
+		}
+		if on_blocklist(target.ip) {
+			log_probe.Warn("skipping blocked resolver", "resolver", target.addr)
+			continue
+		}
+		resolvers = append(resolvers, target)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	log_main.Info("read resolvers", "resolvers", len(resolvers))
+}
+
+// parses the TXT strings the echo authoritative answers with
+// returns nil if none of the strings belongs to the echo format
+func parse_echo_txt(txt []string) *echo_record {
+	var record *echo_record = nil
+	for _, field := range txt {
+		key, value, found := strings.Cut(field, "=")
+		if !found || key != "ecs" && key != "src" && key != "ts" {
+			continue
+		}
+		if record == nil {
+			record = &echo_record{}
+		}
+		switch key {
+		case "ecs":
+			if value == "none" {
+				continue
+			}
+			// <family>/<address>/<source-prefix>
+			parts := strings.Split(value, "/")
+			if len(parts) != 3 {
+				continue
+			}
+			family, err := strconv.Atoi(parts[0])
+			if err != nil {
+				continue
+			}
+			prefix, err := strconv.Atoi(parts[2])
+			if err != nil {
+				continue
+			}
+			ip := net.ParseIP(parts[1])
+			if ip == nil {
+				continue
+			}
+			bits := 32
+			if family == 2 {
+				bits = 128
+			} else {
+				ip = ip.To4()
+			}
+			record.ecs_family = uint16(family)
+			record.ecs_subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, bits)}
+		case "src":
+			record.src_ip = net.ParseIP(value)
+		case "ts":
+			nanos, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				record.timestamp = time.Unix(0, nanos)
+			}
+		}
+	}
+	return record
+}
+
+// compares the subnet we sent with the one the authoritative received
+func classify_echo(sent *net.IPNet, echo *echo_record) string {
+	if echo == nil {
+		return ECS_NO_ANSWER
+	}
+	if echo.ecs_subnet == nil {
+		return ECS_STRIPPED
+	}
+	sent_ones, sent_bits := sent.Mask.Size()
+	seen_ones, seen_bits := echo.ecs_subnet.Mask.Size()
+	if sent_bits != seen_bits {
+		return ECS_REPLACED
+	}
+	seen_net := echo.ecs_subnet.IP.Mask(echo.ecs_subnet.Mask)
+	if seen_ones == sent_ones && seen_net.Equal(sent.IP.Mask(sent.Mask)) {
+		return ECS_FORWARDED
+	}
+	if seen_ones < sent_ones && seen_net.Equal(sent.IP.Mask(echo.ecs_subnet.Mask)) {
+		return ECS_TRUNCATED
+	}
+	return ECS_REPLACED
+}
+
+// every probe gets its own name, so that no resolver can answer from its cache
+func probe_qname() string {
+	label := make([]byte, 8)
+	rand.Read(label)
+	return hex.EncodeToString(label) + "." + strings.Trim(cfg.Probe_zone, ".")
+}
+
+func probe_query(ctx context.Context, resolver *resolver_target, subnet *net.IPNet) *probe_item {
+	qname := probe_qname()
+	log_probe.Debug("probing resolver", "resolver", resolver.addr, "qname", qname, "subnet", subnet)
+	item := &probe_item{
+		resolver:   resolver,
+		qname:      qname,
+		req_subnet: subnet,
+		query_id:   next_query_id(),
+	}
+
+	msg := ecs.New_ecs_msg(qname, dns.TypeTXT, subnet)
+	ctx = ecs.With_source(ctx, sources.Next(resolver.ip))
+	item.sent_at = time.Now()
+	rec, _, err := exchange(ctx, query_transport, msg, resolver.addr, item.query_id, "probe")
+	if err != nil {
+		log_probe.Error("probe query failed", "resolver", resolver.addr, "qname", qname, "subnet", subnet, "err", err)
+		item.class = ECS_NO_ANSWER
+		return item
+	}
+	for _, ans := range rec.Answer {
+		switch ans := ans.(type) {
+		case *dns.TXT:
+			if echo := parse_echo_txt(ans.Txt); echo != nil {
+				item.echo = echo
+			}
+		}
+	}
+	item.class = classify_echo(subnet, item.echo)
+	item.ans_subnet, item.ans_scope = ecs.Get_ecs_opt(rec)
+	log_trace(log_probe, "resolver classified", "resolver", resolver.addr, "subnet", subnet, "class", item.class)
+	return item
+}
+
+// probes until jobs is closed and drained, the rest of the jobs is dropped once cancelled
+func probe_worker(ctx context.Context, jobs chan *probe_job) {
+	defer wg_scan.Done()
+	for job := range jobs {
+		if ctx.Err() != nil {
+			continue
+		}
+		write_probe_chan <- probe_query(ctx, job.resolver, job.subnet)
+		progress.step()
+		// the subnet is complete once the last of its probes is queued for writing
+		if job.remaining.Add(-1) == 0 && ctx.Err() == nil {
+			complete_subnet(job.subnet.String())
+		}
+	}
+}
+
+func probe_resolvers() {
+	log_probe.Info("starting resolver probing", "phase", "probe-resolvers")
+	phase_start("probe-resolvers")
+	defer phase_end("probe-resolvers")
+	defer profile_phase("probe")()
+	ctx, cancel := with_timeout(run_ctx, cfg.Phase_timeout)
+	defer cancel()
+	start_writer(writeout_probe)
+	read_resolvers()
+	read_subnets()
+
+	jobs := make(chan *probe_job, 256)
+	for i := 0; i < cfg.Simul_ecs_reqs; i++ {
+		wg_scan.Add(1)
+		go probe_worker(ctx, jobs)
+	}
+	progress.begin("probe-resolvers", len(subnets)*len(resolvers))
+	go func() {
+		defer close(jobs)
+	feed:
+		for i, subnet := range subnets {
+			log_probe.Info("probing subnet", "phase", "probe-resolvers", "index", i, "subnet", subnet)
+			metric_subnet_index.Set(float64(i))
+			shuffle(resolvers)
+			if len(resolvers) == 0 {
+				complete_subnet(subnet.String())
+				continue
+			}
+			remaining := new(atomic.Int64)
+			remaining.Store(int64(len(resolvers)))
+			for _, resolver := range resolvers {
+				select {
+				case jobs <- &probe_job{resolver: resolver, subnet: subnet, remaining: remaining}:
+				case <-ctx.Done():
+					break feed
+				}
+			}
+		}
+		log_probe.Info("waiting to end resolver probing", "phase", "probe-resolvers")
+	}()
+	wg_scan.Wait()
+}
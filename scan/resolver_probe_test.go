@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs/ecs"
+
+	"github.com/miekg/dns"
+)
+
+func test_subnet(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subnet
+}
+
+// a resolver that changes the ecs option of the query with modify and hands it to the
+// echo authoritative, started on a free port of 127.0.0.1
+func start_test_resolver(t *testing.T, modify func(opt *dns.OPT)) *resolver_target {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			if opt := req.IsEdns0(); opt != nil {
+				modify(opt)
+			}
+			echo_handler(w, req)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	return &resolver_target{ip: addr.IP, addr: addr.String()}
+}
+
+func ecs_option(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, option := range opt.Option {
+		if e, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestProbeQuery(t *testing.T) {
+	cfg.Echo_zone = "echo.test"
+	cfg.Probe_zone = "echo.test"
+	cfg.Query_timeout_ms = 2000
+	query_transport = &ecs.Udp_transport{Timeout: 2 * time.Second}
+
+	forward := func(opt *dns.OPT) {}
+	truncate := func(opt *dns.OPT) {
+		e := ecs_option(opt)
+		e.SourceNetmask = 16
+		e.Address = e.Address.Mask(net.CIDRMask(16, 32))
+	}
+	replace := func(opt *dns.OPT) {
+		e := ecs_option(opt)
+		e.Address = net.ParseIP("198.51.100.0").To4()
+	}
+	strip := func(opt *dns.OPT) {
+		opt.Option = []dns.EDNS0{}
+	}
+	tests := []struct {
+		name        string
+		modify      func(opt *dns.OPT)
+		subnet      string
+		class       string
+		seen_subnet string // empty if the authoritative saw no ecs
+	}{
+		{"forwarded", forward, "203.0.113.0/24", ECS_FORWARDED, "203.0.113.0/24"},
+		{"forwarded v6", forward, "2001:db8:1::/48", ECS_FORWARDED, "2001:db8:1::/48"},
+		{"truncated", truncate, "203.0.113.0/24", ECS_TRUNCATED, "203.0.0.0/16"},
+		{"replaced", replace, "203.0.113.0/24", ECS_REPLACED, "198.51.100.0/24"},
+		{"stripped", strip, "203.0.113.0/24", ECS_STRIPPED, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := start_test_resolver(t, test.modify)
+			item := probe_query(context.Background(), resolver, test_subnet(t, test.subnet))
+			if item.class != test.class {
+				t.Fatalf("class = %s, want %s", item.class, test.class)
+			}
+			if item.echo == nil {
+				t.Fatal("no echo record")
+			}
+			if !item.echo.src_ip.Equal(resolver.ip) {
+				t.Errorf("echo src = %s, want %s", item.echo.src_ip, resolver.ip)
+			}
+			if item.sent_at.IsZero() || item.echo.timestamp.Before(item.sent_at) {
+				t.Errorf("echo received at %s, before the query was sent at %s", item.echo.timestamp, item.sent_at)
+			}
+			row := item.to_csv_strarr()
+			if len(row) != 13 {
+				t.Fatalf("%d columns, want 13", len(row))
+			}
+			if row[12] != item.echo.timestamp.Format("2006-01-02 15:04:05.000000") {
+				t.Errorf("seen at = %q, want %s", row[12], item.echo.timestamp)
+			}
+			if test.seen_subnet == "" {
+				if item.echo.ecs_subnet != nil || row[4] != "" || row[5] != "" {
+					t.Errorf("seen subnet %s (%q, %q), want none", item.echo.ecs_subnet, row[4], row[5])
+				}
+				return
+			}
+			seen := test_subnet(t, test.seen_subnet)
+			seen_ones, _ := seen.Mask.Size()
+			if row[4] != seen.String() {
+				t.Errorf("seen subnet = %s, want %s", row[4], seen)
+			}
+			family := "1"
+			if seen.IP.To4() == nil {
+				family = "2"
+			}
+			if row[11] != family {
+				t.Errorf("seen family = %s, want %s", row[11], family)
+			}
+			if row[5] != strconv.Itoa(seen_ones) {
+				t.Errorf("seen prefix = %s, want %d", row[5], seen_ones)
+			}
+			// the echo authoritative answers with the subnet it saw as scope
+			if item.ans_scope == nil {
+				t.Fatal("no ecs option in the answer")
+			}
+			if scope, _ := item.ans_scope.Size(); scope != seen_ones {
+				t.Errorf("answer scope = %d, want %d", scope, seen_ones)
+			}
+		})
+	}
+}
+
+func TestParseEchoTxt(t *testing.T) {
+	tests := []struct {
+		name   string
+		txt    []string
+		subnet string // empty for no ecs
+		family uint16
+		src    string
+	}{
+		{"v4", []string{"ecs=1/203.0.113.0/24", "src=192.0.2.1", "ts=1700000000000000000"}, "203.0.113.0/24", 1, "192.0.2.1"},
+		{"v6", []string{"ecs=2/2001:db8::/56", "src=2001:db8::53", "ts=1700000000000000000"}, "2001:db8::/56", 2, "2001:db8::53"},
+		{"none", []string{"ecs=none", "src=192.0.2.1", "ts=1700000000000000000"}, "", 0, "192.0.2.1"},
+		{"malformed ecs", []string{"ecs=1/203.0.113.0", "src=192.0.2.1"}, "", 0, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := parse_echo_txt(test.txt)
+			if record == nil {
+				t.Fatal("no record")
+			}
+			if test.subnet == "" {
+				if record.ecs_subnet != nil {
+					t.Errorf("subnet = %s, want none", record.ecs_subnet)
+				}
+			} else if record.ecs_subnet.String() != test.subnet || record.ecs_family != test.family {
+				t.Errorf("subnet = %d %s, want %d %s", record.ecs_family, record.ecs_subnet, test.family, test.subnet)
+			}
+			if !record.src_ip.Equal(net.ParseIP(test.src)) {
+				t.Errorf("src = %s, want %s", record.src_ip, test.src)
+			}
+		})
+	}
+	if record := parse_echo_txt([]string{"v=spf1 -all"}); record != nil {
+		t.Errorf("record for a foreign TXT: %+v", record)
+	}
+	record := parse_echo_txt([]string{"ts=1700000000000000000"})
+	if record == nil || !record.timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("timestamp not parsed: %+v", record)
+	}
+}
+
+func TestClassifyEcho(t *testing.T) {
+	sent := "203.0.113.0/24"
+	tests := []struct {
+		seen  string // "-" for no echo, empty for no ecs
+		class string
+	}{
+		{"-", ECS_NO_ANSWER},
+		{"", ECS_STRIPPED},
+		{"203.0.113.0/24", ECS_FORWARDED},
+		{"203.0.0.0/16", ECS_TRUNCATED},
+		{"203.0.113.0/25", ECS_REPLACED},
+		{"198.51.100.0/24", ECS_REPLACED},
+		{"198.51.0.0/16", ECS_REPLACED},
+		{"2001:db8::/24", ECS_REPLACED},
+	}
+	for _, test := range tests {
+		var echo *echo_record = nil
+		switch test.seen {
+		case "-":
+		case "":
+			echo = &echo_record{}
+		default:
+			echo = &echo_record{ecs_subnet: test_subnet(t, test.seen)}
+		}
+		if class := classify_echo(test_subnet(t, sent), echo); class != test.class {
+			t.Errorf("classify_echo(%s, %q) = %s, want %s", sent, test.seen, class, test.class)
+		}
+	}
+}
+
+// a subnet is only complete once all its probes are queued for writing, none are
+// after a cancellation
+func TestProbeWorkerCompletes(t *testing.T) {
+	cfg.Echo_zone = "echo.test"
+	cfg.Probe_zone = "echo.test"
+	cfg.Query_timeout_ms = 2000
+	query_transport = &ecs.Udp_transport{Timeout: 2 * time.Second}
+	resolver := start_test_resolver(t, func(opt *dns.OPT) {})
+	subnets := []*net.IPNet{test_subnet(t, "203.0.113.0/24"), test_subnet(t, "198.51.100.0/24")}
+
+	run := func(ctx context.Context) []string {
+		reset_completed()
+		jobs := make(chan *probe_job, 8)
+		for _, subnet := range subnets {
+			remaining := new(atomic.Int64)
+			remaining.Store(3)
+			for i := 0; i < 3; i++ {
+				jobs <- &probe_job{resolver: resolver, subnet: subnet, remaining: remaining}
+			}
+		}
+		close(jobs)
+		wg_scan.Add(2)
+		go probe_worker(ctx, jobs)
+		go probe_worker(ctx, jobs)
+		wg_scan.Wait()
+		for len(write_probe_chan) > 0 {
+			<-write_probe_chan
+		}
+		completed_mu.Lock()
+		defer completed_mu.Unlock()
+		return slices.Clone(completed_subnets)
+	}
+
+	completed := run(context.Background())
+	slices.Sort(completed)
+	if want := []string{"198.51.100.0/24", "203.0.113.0/24"}; !slices.Equal(completed, want) {
+		t.Errorf("completed %v, want %v", completed, want)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if completed := run(ctx); len(completed) != 0 {
+		t.Errorf("completed %v after the cancellation", completed)
+	}
+}
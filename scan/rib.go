@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// routing data
+// reads the routed prefixes with their origin as from a caida prefix-to-as dump
+// (prefix, length and as separated by whitespace, one per line) or from an mrt rib
+// dump (TABLE_DUMP_V2, as written by routeviews and ris), plain or compressed with
+// gzip or bzip2. the format is told apart by the content, not by the file name
+
+const (
+	mrt_table_dump    = 12
+	mrt_table_dump_v2 = 13
+
+	mrt_rib_ipv4_unicast = 2
+	mrt_rib_ipv6_unicast = 4
+
+	bgp_attr_as_path     = 2
+	bgp_attr_ext_length  = 0x10
+	bgp_as_path_sequence = 2
+)
+
+// calls fn with every routed prefix of the file at path and its origin as
+func read_rib(path string, fn func(prefix *net.IPNet, origin uint32)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(3)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		zip_reader, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer zip_reader.Close()
+		reader = bufio.NewReader(zip_reader)
+	case string(magic) == "BZh":
+		reader = bufio.NewReader(bzip2.NewReader(reader))
+	}
+
+	header, _ := reader.Peek(6)
+	if len(header) == 6 {
+		switch binary.BigEndian.Uint16(header[4:6]) {
+		case mrt_table_dump_v2:
+			return read_mrt(path, reader, fn)
+		case mrt_table_dump:
+			return fmt.Errorf("%s: only TABLE_DUMP_V2 mrt files are supported", path)
+		}
+	}
+	return read_pfx2as(path, reader, fn)
+}
+
+func read_pfx2as(path string, reader io.Reader, fn func(prefix *net.IPNet, origin uint32)) error {
+	scanner := bufio.NewScanner(reader)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return fmt.Errorf("%s:%d: expected prefix, length and as", path, line_number)
+		}
+		_, prefix, err := net.ParseCIDR(fields[0] + "/" + fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line_number, err)
+		}
+		// multi origin (1_2) and as sets (1,2): the first as is taken
+		as_str, _, _ := strings.Cut(fields[2], "_")
+		as_str, _, _ = strings.Cut(as_str, ",")
+		origin, err := strconv.ParseUint(as_str, 10, 32)
+		if err != nil {
+			log_main.Debug("skipping prefix without a single origin", "prefix", prefix, "as", fields[2])
+			continue
+		}
+		fn(prefix, uint32(origin))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func read_mrt(path string, reader io.Reader, fn func(prefix *net.IPNet, origin uint32)) error {
+	header := make([]byte, 12)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		mrt_type := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if mrt_type != mrt_table_dump_v2 {
+			continue
+		}
+		var bits int
+		switch subtype {
+		case mrt_rib_ipv4_unicast:
+			bits = 32
+		case mrt_rib_ipv6_unicast:
+			bits = 128
+		default:
+			// the peer index table and the multicast and add-path ribs
+			continue
+		}
+		prefix, origin, err := parse_rib_entry(body, bits)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if origin != 0 {
+			fn(prefix, origin)
+		}
+	}
+}
+
+var err_mrt_truncated = errors.New("truncated mrt record")
+
+// the prefix of a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record and the origin as most
+// of its peers saw, 0 if none had one
+func parse_rib_entry(body []byte, bits int) (*net.IPNet, uint32, error) {
+	if len(body) < 5 {
+		return nil, 0, err_mrt_truncated
+	}
+	ones := int(body[4])
+	n := (ones + 7) / 8
+	if ones > bits || len(body) < 5+n+2 {
+		return nil, 0, err_mrt_truncated
+	}
+	ip := make(net.IP, bits/8)
+	copy(ip, body[5:5+n])
+	prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+	prefix.IP = prefix.IP.Mask(prefix.Mask)
+
+	count := int(binary.BigEndian.Uint16(body[5+n:]))
+	entries := body[5+n+2:]
+	origins := make(map[uint32]int)
+	var best uint32 = 0
+	for i := 0; i < count; i++ {
+		// peer index, originated time, attribute length
+		if len(entries) < 8 {
+			return nil, 0, err_mrt_truncated
+		}
+		attr_len := int(binary.BigEndian.Uint16(entries[6:8]))
+		if len(entries) < 8+attr_len {
+			return nil, 0, err_mrt_truncated
+		}
+		origin, err := as_path_origin(entries[8 : 8+attr_len])
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = entries[8+attr_len:]
+		if origin == 0 {
+			continue
+		}
+		origins[origin]++
+		if origins[origin] > origins[best] {
+			best = origin
+		}
+	}
+	return prefix, best, nil
+}
+
+// the last as of the as path in the bgp path attributes, 0 if it ends with an as set
+// the as numbers of TABLE_DUMP_V2 are always 4 bytes long
+func as_path_origin(attrs []byte) (uint32, error) {
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return 0, err_mrt_truncated
+		}
+		flags, attr_type := attrs[0], attrs[1]
+		length, offset := int(attrs[2]), 3
+		if flags&bgp_attr_ext_length != 0 {
+			if len(attrs) < 4 {
+				return 0, err_mrt_truncated
+			}
+			length, offset = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		}
+		if len(attrs) < offset+length {
+			return 0, err_mrt_truncated
+		}
+		value := attrs[offset : offset+length]
+		attrs = attrs[offset+length:]
+		if attr_type != bgp_attr_as_path {
+			continue
+		}
+		var origin uint32 = 0
+		for len(value) > 0 {
+			if len(value) < 2 || len(value) < 2+int(value[1])*4 {
+				return 0, err_mrt_truncated
+			}
+			segment_type, ases := value[0], int(value[1])
+			origin = 0
+			if segment_type == bgp_as_path_sequence && ases > 0 {
+				origin = binary.BigEndian.Uint32(value[2+(ases-1)*4:])
+			}
+			value = value[2+ases*4:]
+		}
+		return origin, nil
+	}
+	return 0, nil
+}
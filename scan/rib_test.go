@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	as_set      = 1
+	as_sequence = bgp_as_path_sequence
+)
+
+type as_segment struct {
+	segment_type byte
+	ases         []uint32
+}
+
+// an ORIGIN attribute followed by the AS_PATH of segments, with the extended length
+// flag if ext_length is set
+func rib_attrs(ext_length bool, segments ...as_segment) []byte {
+	path := []byte{}
+	for _, segment := range segments {
+		path = append(path, segment.segment_type, byte(len(segment.ases)))
+		for _, as := range segment.ases {
+			path = binary.BigEndian.AppendUint32(path, as)
+		}
+	}
+	attrs := []byte{0x40, 1, 1, 0}
+	if ext_length {
+		attrs = append(attrs, 0x40|bgp_attr_ext_length, bgp_attr_as_path)
+		attrs = binary.BigEndian.AppendUint16(attrs, uint16(len(path)))
+	} else {
+		attrs = append(attrs, 0x40, bgp_attr_as_path, byte(len(path)))
+	}
+	return append(attrs, path...)
+}
+
+// the body of a RIB_IPV4_UNICAST or RIB_IPV6_UNICAST record with one entry per attrs
+func rib_body(prefix []byte, ones int, attrs ...[]byte) []byte {
+	body := []byte{0, 0, 0, 1, byte(ones)}
+	body = append(body, prefix[:(ones+7)/8]...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(attrs)))
+	for i, attr := range attrs {
+		body = binary.BigEndian.AppendUint16(body, uint16(i))
+		body = binary.BigEndian.AppendUint32(body, 1700000000)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(attr)))
+		body = append(body, attr...)
+	}
+	return body
+}
+
+func seq(ases ...uint32) as_segment {
+	return as_segment{segment_type: as_sequence, ases: ases}
+}
+
+func set(ases ...uint32) as_segment {
+	return as_segment{segment_type: as_set, ases: ases}
+}
+
+func TestParseRibEntry(t *testing.T) {
+	v4 := net.ParseIP("10.1.31.0").To4()
+	v6 := net.ParseIP("2001:db8:ffff::")
+	tests := []struct {
+		name   string
+		body   []byte
+		bits   int
+		prefix string
+		origin uint32
+		err    error
+	}{
+		{"v4 sequence", rib_body(v4, 16, rib_attrs(false, seq(3356, 64500))), 32, "10.1.0.0/16", 64500, nil},
+		{"v4 host bits", rib_body(v4, 20, rib_attrs(false, seq(64500))), 32, "10.1.16.0/20", 64500, nil},
+		{"v4 default route", rib_body(v4, 0, rib_attrs(false, seq(64500))), 32, "0.0.0.0/0", 64500, nil},
+		{"v6 sequence", rib_body(v6, 32, rib_attrs(false, seq(6939, 65001))), 128, "2001:db8::/32", 65001, nil},
+		{"v6 /48", rib_body(v6, 48, rib_attrs(false, seq(65001))), 128, "2001:db8:ffff::/48", 65001, nil},
+		{"extended length", rib_body(v4, 16, rib_attrs(true, seq(3356, 1299, 64500))), 32, "10.1.0.0/16", 64500, nil},
+		{"most peers",
+			rib_body(v4, 16, rib_attrs(false, seq(1, 100)), rib_attrs(false, seq(2, 200)), rib_attrs(false, seq(3, 200))),
+			32, "10.1.0.0/16", 200, nil},
+		{"as set at the end", rib_body(v4, 16, rib_attrs(false, seq(3356), set(64500, 64501))), 32, "10.1.0.0/16", 0, nil},
+		{"as set before the sequence", rib_body(v4, 16, rib_attrs(false, set(64500, 64501), seq(64502))), 32, "10.1.0.0/16", 64502, nil},
+		{"as set of one peer",
+			rib_body(v4, 16, rib_attrs(false, seq(3356), set(64500)), rib_attrs(false, seq(1299, 64510))),
+			32, "10.1.0.0/16", 64510, nil},
+		{"empty as path", rib_body(v4, 16, rib_attrs(false)), 32, "10.1.0.0/16", 0, nil},
+		{"no entries", rib_body(v4, 16), 32, "10.1.0.0/16", 0, nil},
+		{"short header", []byte{0, 0, 0, 1}, 32, "", 0, err_mrt_truncated},
+		{"prefix too long", rib_body(v6, 33, rib_attrs(false, seq(1))), 32, "", 0, err_mrt_truncated},
+		{"missing prefix", []byte{0, 0, 0, 1, 24, 10}, 32, "", 0, err_mrt_truncated},
+		{"missing entry", rib_body(v4, 16, rib_attrs(false, seq(1)))[:12], 32, "", 0, err_mrt_truncated},
+		{"missing attributes", func() []byte {
+			body := rib_body(v4, 16, rib_attrs(false, seq(1)))
+			return body[:len(body)-2]
+		}(), 32, "", 0, err_mrt_truncated},
+		{"segment longer than the attribute", func() []byte {
+			attrs := rib_attrs(false, seq(1, 2))
+			attrs[len(attrs)-9] = 3 // as count of the segment
+			return rib_body(v4, 16, attrs)
+		}(), 32, "", 0, err_mrt_truncated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefix, origin, err := parse_rib_entry(test.body, test.bits)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if prefix.String() != test.prefix || origin != test.origin {
+				t.Errorf("got %s AS%d, want %s AS%d", prefix, origin, test.prefix, test.origin)
+			}
+		})
+	}
+}
+
+func mrt_record(mrt_type uint16, subtype uint16, body []byte) []byte {
+	record := binary.BigEndian.AppendUint32(nil, 1700000000)
+	record = binary.BigEndian.AppendUint16(record, mrt_type)
+	record = binary.BigEndian.AppendUint16(record, subtype)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(body)))
+	return append(record, body...)
+}
+
+type routed_prefix struct {
+	prefix string
+	origin uint32
+}
+
+func collect_rib(t *testing.T, path string) ([]routed_prefix, error) {
+	t.Helper()
+	got := []routed_prefix{}
+	err := read_rib(path, func(prefix *net.IPNet, origin uint32) {
+		got = append(got, routed_prefix{prefix.String(), origin})
+	})
+	return got, err
+}
+
+func TestReadRib(t *testing.T) {
+	dir := t.TempDir()
+	mrt := bytes.Join([][]byte{
+		// peer index table, skipped
+		mrt_record(mrt_table_dump_v2, 1, []byte{192, 0, 2, 1, 0, 0, 0, 0}),
+		mrt_record(mrt_table_dump_v2, mrt_rib_ipv4_unicast, rib_body(net.IPv4(10, 1, 0, 0).To4(), 16, rib_attrs(false, seq(3356, 64500)))),
+		// ends with an as set, skipped
+		mrt_record(mrt_table_dump_v2, mrt_rib_ipv4_unicast, rib_body(net.IPv4(10, 2, 0, 0).To4(), 16, rib_attrs(false, set(64501, 64502)))),
+		// bgp4mp message, skipped
+		mrt_record(16, 4, []byte{1, 2, 3}),
+		mrt_record(mrt_table_dump_v2, mrt_rib_ipv6_unicast, rib_body(net.ParseIP("2001:db8::"), 32, rib_attrs(true, seq(6939, 65001)))),
+	}, nil)
+	want := []routed_prefix{{"10.1.0.0/16", 64500}, {"2001:db8::/32", 65001}}
+	pfx2as := "# routeviews prefix2as\n10.1.0.0\t16\t64500\n\n2001:db8::\t32\t65001\n"
+
+	var gz bytes.Buffer
+	zip_writer := gzip.NewWriter(&gz)
+	zip_writer.Write(mrt)
+	zip_writer.Close()
+
+	files := map[string][]byte{
+		"rib.mrt":        mrt,
+		"rib.gz":         gz.Bytes(),
+		"pfx2as.txt":     []byte(pfx2as),
+		"truncated.mrt":  mrt[:len(mrt)-3],
+		"table_dump.mrt": mrt_record(mrt_table_dump, 1, make([]byte, 20)),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"rib.mrt", "rib.gz", "pfx2as.txt"} {
+		got, err := collect_rib(t, filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	if _, err := collect_rib(t, filepath.Join(dir, "truncated.mrt")); err == nil {
+		t.Error("no error for a truncated mrt file")
+	}
+	if _, err := collect_rib(t, filepath.Join(dir, "table_dump.mrt")); err == nil || !strings.Contains(err.Error(), "TABLE_DUMP_V2") {
+		t.Errorf("err = %v for a TABLE_DUMP file", err)
+	}
+}
+
+func TestReadPfx2as(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines string
+		want  []routed_prefix
+		err   string // the start of the error, empty for none
+	}{
+		{"single origins", "1.0.0.0\t24\t13335\n2001:db8::\t32\t65001\n",
+			[]routed_prefix{{"1.0.0.0/24", 13335}, {"2001:db8::/32", 65001}}, ""},
+		{"comments and blank lines", "# prefix length as\n\n   \n1.0.0.0 24 13335 # trailing\n",
+			[]routed_prefix{{"1.0.0.0/24", 13335}}, ""},
+		{"multi origin", "1.0.4.0\t22\t38803_56203\n", []routed_prefix{{"1.0.4.0/22", 38803}}, ""},
+		{"as set", "1.0.16.0\t20\t2519,7500\n", []routed_prefix{{"1.0.16.0/20", 2519}}, ""},
+		{"multi origin with as set", "1.0.32.0\t19\t4134,4808_4837\n", []routed_prefix{{"1.0.32.0/19", 4134}}, ""},
+		{"host bits", "1.0.0.1\t24\t13335\n", []routed_prefix{{"1.0.0.0/24", 13335}}, ""},
+		{"unparseable as skipped", "1.0.0.0\t24\t{13335}\n1.0.1.0\t24\tAS13335\n1.0.2.0\t24\t4294967296\n1.0.3.0\t24\t13335\n",
+			[]routed_prefix{{"1.0.3.0/24", 13335}}, ""},
+		{"missing as", "1.0.0.0\t24\t13335\n1.0.1.0\t24\n", []routed_prefix{{"1.0.0.0/24", 13335}}, "test:2: expected prefix"},
+		{"bad address", "1.0.0.300\t24\t13335\n", []routed_prefix{}, "test:1: "},
+		{"bad length", "\n1.0.0.0\t33\t13335\n", []routed_prefix{}, "test:2: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []routed_prefix{}
+			err := read_pfx2as("test", strings.NewReader(test.lines), func(prefix *net.IPNet, origin uint32) {
+				got = append(got, routed_prefix{prefix.String(), origin})
+			})
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("err = %v", err)
+			case test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)):
+				t.Errorf("err = %v, want %s...", err, test.err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
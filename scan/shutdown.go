@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// graceful shutdown
+// the first SIGINT or SIGTERM (or the end of run_timeout) cancels run_ctx: the feeders
+// stop handing out work, the workers return after their current query, the writers
+// drain their channels and close the files properly and a checkpoint of what was
+// completed is written
+// a second signal ends the program immediately
+//
+// every phase runs with a context derived from run_ctx, limited by phase_timeout,
+// every resolution of a domain by resolve_timeout and every query by query_timeout_ms
+
+var run_ctx, cancel_run = context.WithCancel(context.Background())
+var interrupted_by os.Signal = nil
+var cancel_timeout context.CancelFunc = nil
+
+// the writers run until write_ctx is done, which is only after the workers are
+var write_ctx, stop_write = context.WithCancel(context.Background())
+
+// every writer goroutine, stop_writers waits for them to finish
+var wg_write sync.WaitGroup
+
+// lets the writers be started again after close_writers, for the next round of repeat
+func reset_writers() {
+	write_ctx, stop_write = context.WithCancel(context.Background())
+}
+
+func handle_signals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log_main.Warn("shutting down, send again to exit immediately", "signal", sig)
+		interrupted_by = sig
+		cancel_run()
+		sig = <-signals
+		log_main.Error("exiting immediately", "signal", sig)
+		os.Exit(130)
+	}()
+}
+
+// limits the whole run to run_timeout, once the config is loaded
+func limit_run() {
+	if cfg.Run_timeout > 0 {
+		// cancel_run still cancels the derived context
+		run_ctx, cancel_timeout = context.WithTimeout(run_ctx, time.Duration(cfg.Run_timeout)*time.Second)
+	}
+}
+
+func interrupted() bool {
+	return run_ctx.Err() != nil
+}
+
+// why the run was cancelled
+func interrupt_reason() string {
+	if interrupted_by != nil {
+		return interrupted_by.String()
+	}
+	if errors.Is(run_ctx.Err(), context.DeadlineExceeded) {
+		return "run_timeout"
+	}
+	return ""
+}
+
+// derives a context that ends after the given seconds, 0 for no limit
+func with_timeout(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+func start_writer(writer func(ctx context.Context)) {
+	wg_write.Add(1)
+	go func() {
+		defer wg_write.Done()
+		writer(write_ctx)
+	}()
+}
+
+// sleeps like time.Sleep but returns early when ctx is done
+func sleep_ctx(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// what an interrupted run got done, so it can be picked up from there
+type run_checkpoint struct {
+	Run_id            string    `json:"run_id"`
+	Command           string    `json:"command"`
+	Reason            string    `json:"reason"`
+	Interrupted_at    time.Time `json:"interrupted_at"`
+	Phase             string    `json:"phase"`
+	Phase_done        uint64    `json:"phase_done"`
+	Phase_total       uint64    `json:"phase_total"`
+	Completed_subnets []string  `json:"completed_subnets"`
+	Rows_written      uint64    `json:"rows_written"`
+	Ns_written        uint64    `json:"ns_written"`
+}
+
+// subnets that were scanned with every domain
+var completed_subnets []string = []string{}
+var completed_mu sync.Mutex
+
+func reset_completed() {
+	completed_mu.Lock()
+	completed_subnets = []string{}
+	completed_mu.Unlock()
+}
+
+func complete_subnet(subnet string) {
+	completed_mu.Lock()
+	completed_subnets = append(completed_subnets, subnet)
+	completed_mu.Unlock()
+}
+
+func write_checkpoint() {
+	done, total, _ := progress.state()
+	progress.mu.Lock()
+	phase := progress.phase
+	progress.mu.Unlock()
+	completed_mu.Lock()
+	checkpoint := &run_checkpoint{
+		Run_id:            cfg.Run_id,
+		Command:           run_command,
+		Reason:            interrupt_reason(),
+		Interrupted_at:    time.Now(),
+		Phase:             phase,
+		Phase_done:        done,
+		Phase_total:       total,
+		Completed_subnets: completed_subnets,
+		Rows_written:      stat_rows.Load(),
+		Ns_written:        stat_ns_rows.Load(),
+	}
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	completed_mu.Unlock()
+	if err != nil {
+		log_main.Error("building checkpoint", "err", err)
+		return
+	}
+	path := output_path("checkpoint", ".json")
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		log_main.Error("writing checkpoint", "path", path, "err", err)
+		return
+	}
+	log_main.Info("checkpoint written", "path", path)
+}
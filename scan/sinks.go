@@ -0,0 +1,443 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"ecs/ecs"
+)
+
+// output sinks
+// scan items, domain-ns pairs and the stability summaries are handed to every
+// configured sink. the baseline items go to their own files (kind baseline), so that
+// they dont mix with the ecs answers of the scan, the same for their summaries (kind
+// baseline_stability)
+// the files of a sink are only created once the first record arrives
+
+type sink interface {
+	write_item(item *scan_item) error
+	write_ns(pair *domain_ns_pair) error
+	write_stability(stability *ecs.Stability) error
+	close() error
+}
+
+var sink_names = []string{"csv", "jsonl", "parquet", "stdout"}
+
+// start of this run, used for the output file names
+var run_start = time.Now()
+
+// builds the path of an output file from output_name
+// {run} is replaced by the run_id, {time} by the start of the run and {kind} by
+// the kind of records in the file (scan, nameserver, ...)
+func output_path(kind string, ext string) string {
+	run_id := cfg.Run_id
+	if run_id == "" {
+		run_id = "run"
+	}
+	name := strings.NewReplacer(
+		"{run}", run_id,
+		"{time}", run_start.Format("2006-01-02_15-04-05"),
+		"{kind}", kind,
+	).Replace(cfg.Output_name)
+	return filepath.Join(cfg.Output_dir, name+ext)
+}
+
+func new_sink(name string) (sink, error) {
+	switch name {
+	case "csv":
+		return &csv_sink{
+			items:                &gz_file{path: output_path("scan", ".csv.gz")},
+			baselines:            &gz_file{path: output_path("baseline", ".csv.gz")},
+			nss:                  &gz_file{path: output_path("nameserver", ".csv.gz")},
+			stabilities:          &gz_file{path: output_path("stability", ".csv.gz")},
+			baseline_stabilities: &gz_file{path: output_path("baseline_stability", ".csv.gz")},
+		}, nil
+	case "jsonl":
+		return &jsonl_sink{
+			items:                &gz_file{path: output_path("scan", ".jsonl.gz")},
+			baselines:            &gz_file{path: output_path("baseline", ".jsonl.gz")},
+			nss:                  &gz_file{path: output_path("nameserver", ".jsonl.gz")},
+			stabilities:          &gz_file{path: output_path("stability", ".jsonl.gz")},
+			baseline_stabilities: &gz_file{path: output_path("baseline_stability", ".jsonl.gz")},
+		}, nil
+	case "parquet":
+		return new_parquet_sink(output_path("scan", ".parquet"), output_path("baseline", ".parquet"), output_path("nameserver", ".parquet"),
+			output_path("stability", ".parquet"), output_path("baseline_stability", ".parquet")), nil
+	case "stdout":
+		return &stdout_sink{encoder: json.NewEncoder(os.Stdout)}, nil
+	}
+	return nil, fmt.Errorf("unknown output sink %s", name)
+}
+
+// hands every record to all the sinks
+type multi_sink struct {
+	sinks []sink
+}
+
+func new_multi_sink(names []string) (*multi_sink, error) {
+	if err := os.MkdirAll(cfg.Output_dir, 0755); err != nil {
+		return nil, err
+	}
+	multi := &multi_sink{sinks: make([]sink, 0, len(names))}
+	for _, name := range names {
+		s, err := new_sink(name)
+		if err != nil {
+			return nil, err
+		}
+		multi.sinks = append(multi.sinks, s)
+	}
+	return multi, nil
+}
+
+func (multi *multi_sink) write_item(item *scan_item) error {
+	errs := make([]error, 0)
+	for _, s := range multi.sinks {
+		errs = append(errs, s.write_item(item))
+	}
+	return errors.Join(errs...)
+}
+
+func (multi *multi_sink) write_ns(pair *domain_ns_pair) error {
+	errs := make([]error, 0)
+	for _, s := range multi.sinks {
+		errs = append(errs, s.write_ns(pair))
+	}
+	return errors.Join(errs...)
+}
+
+func (multi *multi_sink) write_stability(stability *ecs.Stability) error {
+	errs := make([]error, 0)
+	for _, s := range multi.sinks {
+		errs = append(errs, s.write_stability(stability))
+	}
+	return errors.Join(errs...)
+}
+
+func (multi *multi_sink) close() error {
+	errs := make([]error, 0)
+	for _, s := range multi.sinks {
+		errs = append(errs, s.close())
+	}
+	return errors.Join(errs...)
+}
+
+// gzip compressed file, created on the first write
+type gz_file struct {
+	path       string
+	file       *os.File
+	zip_writer *gzip.Writer
+}
+
+func (f *gz_file) writer() (io.Writer, error) {
+	if f.zip_writer != nil {
+		return f.zip_writer, nil
+	}
+	file, err := os.Create(f.path)
+	if err != nil {
+		return nil, err
+	}
+	log_writer.Info("writing to file", "path", f.path)
+	f.file = file
+	f.zip_writer = gzip.NewWriter(file)
+	return f.zip_writer, nil
+}
+
+func (f *gz_file) close() error {
+	if f.zip_writer == nil {
+		return nil
+	}
+	return errors.Join(f.zip_writer.Close(), f.file.Close())
+}
+
+// the csv format will be as follows:
+// domain;nameserver-ip;resolve-ms;[ns-rtt-ms]
+func (pair *domain_ns_pair) to_csv_strarr() []string {
+	return []string{pair.domain, pair.nsip.String(), ms_str(pair.resolve_duration), ms_str(pair.ns_rtt)}
+}
+
+type csv_sink struct {
+	items         *gz_file
+	baselines     *gz_file
+	nss           *gz_file
+	items_csv     *csv.Writer
+	baselines_csv *csv.Writer
+	nss_csv       *csv.Writer
+
+	stabilities              *gz_file
+	baseline_stabilities     *gz_file
+	stabilities_csv          *csv.Writer
+	baseline_stabilities_csv *csv.Writer
+}
+
+func csv_writer(f *gz_file, w **csv.Writer) (*csv.Writer, error) {
+	if *w != nil {
+		return *w, nil
+	}
+	out, err := f.writer()
+	if err != nil {
+		return nil, err
+	}
+	*w = csv.NewWriter(out)
+	(*w).Comma = ';'
+	return *w, nil
+}
+
+func (s *csv_sink) write_item(item *scan_item) error {
+	f, w_ptr := s.items, &s.items_csv
+	if item.baseline {
+		f, w_ptr = s.baselines, &s.baselines_csv
+	}
+	w, err := csv_writer(f, w_ptr)
+	if err != nil {
+		return err
+	}
+	return w.Write(item.to_csv_strarr())
+}
+
+func (s *csv_sink) write_ns(pair *domain_ns_pair) error {
+	w, err := csv_writer(s.nss, &s.nss_csv)
+	if err != nil {
+		return err
+	}
+	return w.Write(pair.to_csv_strarr())
+}
+
+func (s *csv_sink) write_stability(stability *ecs.Stability) error {
+	f, w_ptr := s.stabilities, &s.stabilities_csv
+	if stability.Baseline {
+		f, w_ptr = s.baseline_stabilities, &s.baseline_stabilities_csv
+	}
+	w, err := csv_writer(f, w_ptr)
+	if err != nil {
+		return err
+	}
+	return w.Write(stability_csv_strarr(stability))
+}
+
+func (s *csv_sink) close() error {
+	errs := make([]error, 0)
+	for _, w := range []*csv.Writer{s.items_csv, s.baselines_csv, s.nss_csv, s.stabilities_csv, s.baseline_stabilities_csv} {
+		if w != nil {
+			w.Flush()
+			errs = append(errs, w.Error())
+		}
+	}
+	errs = append(errs, s.items.close(), s.baselines.close(), s.nss.close(), s.stabilities.close(), s.baseline_stabilities.close())
+	return errors.Join(errs...)
+}
+
+// json representation of the records, shared by the jsonl and stdout sinks
+type scan_json struct {
+	Record          string   `json:"record"`
+	Timestamp       string   `json:"timestamp"`
+	Domain          string   `json:"domain"`
+	Ns_ip           string   `json:"ns_ip"`
+	Subnet          string   `json:"subnet"`
+	Returned_subnet *string  `json:"returned_subnet"`
+	Scope           *int     `json:"scope"`
+	Returned_ips    []string `json:"returned_ips"`
+	Query_id        uint64   `json:"query_id"`
+	Rtt_ms          *float64 `json:"rtt_ms"`
+	Source_ip       *string  `json:"source_ip"`
+}
+
+type ns_json struct {
+	Record     string   `json:"record"`
+	Domain     string   `json:"domain"`
+	Ns_ip      string   `json:"ns_ip"`
+	Resolve_ms float64  `json:"resolve_ms"`
+	Ns_rtt_ms  *float64 `json:"ns_rtt_ms"`
+}
+
+// nil for 0, so that missing rtts dont look like very fast ones
+func ms_ptr(d time.Duration) *float64 {
+	if d == 0 {
+		return nil
+	}
+	ms := float64(d.Microseconds()) / 1000
+	return &ms
+}
+
+func (item *scan_item) to_json() *scan_json {
+	record := &scan_json{
+		Record:       "scan",
+		Timestamp:    item.sent_at.Format(time.RFC3339Nano),
+		Domain:       item.domain_ns.domain,
+		Ns_ip:        item.domain_ns.nsip.String(),
+		Subnet:       subnet_str(item.req_subnet),
+		Returned_ips: make([]string, 0, len(item.ans_ips)),
+		Query_id:     item.query_id,
+		Rtt_ms:       ms_ptr(item.rtt),
+	}
+	if item.baseline {
+		record.Record = "baseline"
+	}
+	if item.ans_subnet != nil {
+		ans_subnet := item.ans_subnet.String()
+		record.Returned_subnet = &ans_subnet
+	}
+	if item.ans_scope != nil {
+		ones, _ := item.ans_scope.Size()
+		record.Scope = &ones
+	}
+	for _, ip := range item.ans_ips {
+		record.Returned_ips = append(record.Returned_ips, ip.String())
+	}
+	if item.source != nil {
+		source := item.source.String()
+		record.Source_ip = &source
+	}
+	return record
+}
+
+func (pair *domain_ns_pair) to_json() *ns_json {
+	return &ns_json{
+		Record:     "nameserver",
+		Domain:     pair.domain,
+		Ns_ip:      pair.nsip.String(),
+		Resolve_ms: float64(pair.resolve_duration.Microseconds()) / 1000,
+		Ns_rtt_ms:  ms_ptr(pair.ns_rtt),
+	}
+}
+
+type jsonl_sink struct {
+	items                *gz_file
+	baselines            *gz_file
+	nss                  *gz_file
+	stabilities          *gz_file
+	baseline_stabilities *gz_file
+}
+
+func write_json(f *gz_file, v any) error {
+	w, err := f.writer()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (s *jsonl_sink) write_item(item *scan_item) error {
+	if item.baseline {
+		return write_json(s.baselines, item.to_json())
+	}
+	return write_json(s.items, item.to_json())
+}
+
+func (s *jsonl_sink) write_ns(pair *domain_ns_pair) error {
+	return write_json(s.nss, pair.to_json())
+}
+
+func (s *jsonl_sink) write_stability(stability *ecs.Stability) error {
+	if stability.Baseline {
+		return write_json(s.baseline_stabilities, stability_to_json(stability))
+	}
+	return write_json(s.stabilities, stability_to_json(stability))
+}
+
+func (s *jsonl_sink) close() error {
+	return errors.Join(s.items.close(), s.baselines.close(), s.nss.close(), s.stabilities.close(), s.baseline_stabilities.close())
+}
+
+// json lines on stdout, the record field tells scan items, baseline items, nameservers
+// and stability summaries apart
+type stdout_sink struct {
+	encoder *json.Encoder
+}
+
+func (s *stdout_sink) write_item(item *scan_item) error {
+	return s.encoder.Encode(item.to_json())
+}
+
+func (s *stdout_sink) write_ns(pair *domain_ns_pair) error {
+	return s.encoder.Encode(pair.to_json())
+}
+
+func (s *stdout_sink) write_stability(stability *ecs.Stability) error {
+	return s.encoder.Encode(stability_to_json(stability))
+}
+
+func (s *stdout_sink) close() error {
+	return nil
+}
+
+// checks the sink names of output_sinks
+func validate_sinks(names []string) error {
+	if len(names) == 0 {
+		return errors.New("output_sinks must not be empty")
+	}
+	for _, name := range names {
+		if !slices.Contains(sink_names, name) {
+			return fmt.Errorf("unknown output sink %q, expected one of %s", name, strings.Join(sink_names, ","))
+		}
+	}
+	return nil
+}
+
+func writeout(ctx context.Context) {
+	out, err := new_multi_sink(cfg.Output_sinks)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := out.close(); err != nil {
+			log_writer.Error("closing output sinks", "err", err)
+		}
+	}()
+
+	write_item := func(item *scan_item) {
+		log_writer.Debug("writing scan item", "domain", item.domain_ns.domain, "subnet", item.req_subnet)
+		if err := out.write_item(item); err != nil {
+			log_writer.Error("writing scan item", "domain", item.domain_ns.domain, "subnet", item.req_subnet, "err", err)
+		} else {
+			stat_rows.Add(1)
+		}
+	}
+	write_ns := func(pair *domain_ns_pair) {
+		log_writer.Debug("writing domain-ns pair", "domain", pair.domain, "server", pair.nsip)
+		if err := out.write_ns(pair); err != nil {
+			log_writer.Error("writing domain-ns pair", "domain", pair.domain, "err", err)
+		} else {
+			stat_ns_rows.Add(1)
+		}
+	}
+	write_stability := func(stability *ecs.Stability) {
+		log_writer.Debug("writing stability", "domain", stability.Domain, "subnet", stability.Subnet)
+		if err := out.write_stability(stability); err != nil {
+			log_writer.Error("writing stability", "domain", stability.Domain, "err", err)
+		}
+	}
+	for {
+		select {
+		case item := <-write_chan:
+			write_item(item)
+		case pair := <-write_ns_chan:
+			write_ns(pair)
+		case stability := <-write_stability_chan:
+			write_stability(stability)
+		case <-ctx.Done():
+			// write what is still waiting in the channels
+			for {
+				select {
+				case item := <-write_chan:
+					write_item(item)
+				case pair := <-write_ns_chan:
+					write_ns(pair)
+				case stability := <-write_stability_chan:
+					write_stability(stability)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
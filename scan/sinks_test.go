@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"ecs/ecs"
+)
+
+// a scan item with all fields set, one of the baseline without ecs and no answer,
+// a domain-ns pair and a stability summary
+func test_records(t *testing.T) (*scan_item, *scan_item, *domain_ns_pair, *ecs.Stability) {
+	pair := &domain_ns_pair{domain: "example.com", nsip: net.ParseIP("192.0.2.53"), resolve_duration: 42100 * time.Microsecond, ns_rtt: 7 * time.Millisecond}
+	sent_at := time.Date(2026, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	item := &scan_item{
+		domain_ns:  pair,
+		req_subnet: test_subnet(t, "203.0.113.0/24"),
+		ans_subnet: test_subnet(t, "203.0.113.0/24"),
+		ans_scope:  net.CIDRMask(20, 32),
+		ans_ips:    []net.IP{net.ParseIP("198.51.100.10"), net.ParseIP("2001:db8::10")},
+		query_id:   17,
+		sent_at:    sent_at,
+		rtt:        12500 * time.Microsecond,
+		source:     net.ParseIP("192.0.2.200"),
+	}
+	baseline := &scan_item{domain_ns: pair, query_id: 18, sent_at: sent_at.Add(time.Second), baseline: true}
+	stability := &ecs.Stability{
+		Domain:     "example.com",
+		Nameserver: pair.nsip,
+		Subnet:     item.req_subnet,
+		Queries:    3,
+		Answered:   3,
+		Answer_sets: []*ecs.Answer_set{
+			{Answers: []string{"198.51.100.10", "198.51.100.11"}, Count: 2},
+			{Answers: []string{"198.51.100.12"}, Count: 1},
+		},
+		Score: 2.0 / 3,
+	}
+	return item, baseline, pair, stability
+}
+
+func read_jsonl[T any](t *testing.T, path string) []*T {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zip_reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make([]*T, 0)
+	scanner := bufio.NewScanner(zip_reader)
+	for scanner.Scan() {
+		record := new(T)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func check_records[T any](t *testing.T, path string, got []T, want ...T) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s:\n got %+v\nwant %+v", filepath.Base(path), got, want)
+	}
+}
+
+// every record written through the multi sink can be read back from the file of each
+// sink, the files of kinds without records are not created
+func TestSinksRoundTrip(t *testing.T) {
+	default_config(t)
+	cfg.Output_dir = filepath.Join(t.TempDir(), "out")
+	cfg.Output_name = "{run}_{kind}"
+	cfg.Run_id = "test"
+	item, baseline, pair, stability := test_records(t)
+
+	out, err := new_multi_sink([]string{"csv", "jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(cfg.Output_dir); len(entries) != 0 {
+		t.Errorf("files before the first record: %v", entries)
+	}
+	for _, err := range []error{out.write_item(item), out.write_item(baseline), out.write_ns(pair), out.write_stability(stability), out.close()} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(cfg.Output_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, entry.Name())
+	}
+	want_files := []string{}
+	for _, kind := range []string{"baseline", "nameserver", "scan", "stability"} {
+		for _, ext := range []string{".csv.gz", ".jsonl.gz"} {
+			want_files = append(want_files, "test_"+kind+ext)
+		}
+	}
+	if !slices.Equal(files, want_files) {
+		t.Errorf("files %v, want %v", files, want_files)
+	}
+
+	path := func(kind string, ext string) string {
+		return filepath.Join(cfg.Output_dir, "test_"+kind+ext)
+	}
+	check_records(t, path("scan", ".csv.gz"), read_gz_csv(t, path("scan", ".csv.gz")),
+		[]string{"2026-01-02 03:04:05.123456", "example.com", "192.0.2.53", "203.0.113.0/24", "203.0.113.0/24", "20", "198.51.100.10,2001:db8::10", "17", "12.500", "192.0.2.200"})
+	check_records(t, path("baseline", ".csv.gz"), read_gz_csv(t, path("baseline", ".csv.gz")),
+		[]string{"2026-01-02 03:04:06.123456", "example.com", "192.0.2.53", "", "", "", "", "18", "", ""})
+	check_records(t, path("nameserver", ".csv.gz"), read_gz_csv(t, path("nameserver", ".csv.gz")),
+		[]string{"example.com", "192.0.2.53", "42.100", "7.000"})
+	check_records(t, path("stability", ".csv.gz"), read_gz_csv(t, path("stability", ".csv.gz")),
+		[]string{"example.com", "192.0.2.53", "203.0.113.0/24", "3", "3", "2", "0.667", "198.51.100.10,198.51.100.11=2|198.51.100.12=1"})
+
+	check_records(t, path("scan", ".jsonl.gz"), read_jsonl[scan_json](t, path("scan", ".jsonl.gz")), item.to_json())
+	check_records(t, path("baseline", ".jsonl.gz"), read_jsonl[scan_json](t, path("baseline", ".jsonl.gz")), baseline.to_json())
+	check_records(t, path("nameserver", ".jsonl.gz"), read_jsonl[ns_json](t, path("nameserver", ".jsonl.gz")), pair.to_json())
+	check_records(t, path("stability", ".jsonl.gz"), read_jsonl[stability_json](t, path("stability", ".jsonl.gz")), stability_to_json(stability))
+	if got := read_jsonl[scan_json](t, path("baseline", ".jsonl.gz"))[0]; got.Record != "baseline" || got.Subnet != "" || got.Scope != nil || got.Rtt_ms != nil {
+		t.Errorf("baseline record %+v", got)
+	}
+
+}
+
+// the baseline summaries go to their own files
+func TestSinksBaselineStability(t *testing.T) {
+	default_config(t)
+	cfg.Output_dir = t.TempDir()
+	_, _, _, stability := test_records(t)
+	stability.Subnet = nil
+	stability.Baseline = true
+
+	out, err := new_multi_sink([]string{"csv", "jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.write_stability(stability); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(cfg.Output_dir)
+	if len(entries) != 2 {
+		t.Errorf("files %v, want only the baseline_stability ones", entries)
+	}
+	if rows := read_gz_csv(t, output_path("baseline_stability", ".csv.gz")); len(rows) != 1 || rows[0][2] != "" {
+		t.Errorf("csv rows %q", rows)
+	}
+	if records := read_jsonl[stability_json](t, output_path("baseline_stability", ".jsonl.gz")); len(records) != 1 || records[0].Record != "baseline_stability" {
+		t.Errorf("jsonl records %+v", records)
+	}
+}
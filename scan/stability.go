@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"ecs/ecs"
+)
+
+// answer consistency
+// with repeat_queries > 1 every ecs query (and every baseline query) is sent that many
+// times, repeat_spacing_ms apart. every answer is a row of its own in the scan files,
+// the summary per (domain, nameserver, subnet) is handed to the output sinks (kind
+// stability, the summaries of the baseline queries kind baseline_stability)
+
+var write_stability_chan = make(chan *ecs.Stability, 4096)
+
+// the csv format will be as follows:
+// domain;nameserver-ip;[req-subnet-cidr];queries;answered;distinct-answer-sets;stability;[ip1,ip2=count|ip3=count|...]
+func stability_csv_strarr(stability *ecs.Stability) []string {
+	sets := make([]string, 0, len(stability.Answer_sets))
+	for _, set := range stability.Answer_sets {
+		sets = append(sets, strings.Join(set.Answers, ",")+"="+strconv.Itoa(set.Count))
+	}
+	return []string{
+		stability.Domain,
+		stability.Nameserver.String(),
+		subnet_str(stability.Subnet),
+		strconv.Itoa(stability.Queries),
+		strconv.Itoa(stability.Answered),
+		strconv.Itoa(len(stability.Answer_sets)),
+		strconv.FormatFloat(stability.Score, 'f', 3, 64),
+		strings.Join(sets, "|"),
+	}
+}
+
+type answer_set_json struct {
+	Answers []string `json:"answers"`
+	Count   int      `json:"count"`
+}
+
+type stability_json struct {
+	Record      string             `json:"record"`
+	Domain      string             `json:"domain"`
+	Ns_ip       string             `json:"ns_ip"`
+	Subnet      string             `json:"subnet"`
+	Queries     int                `json:"queries"`
+	Answered    int                `json:"answered"`
+	Answer_sets []*answer_set_json `json:"answer_sets"`
+	Stability   float64            `json:"stability"`
+}
+
+func stability_to_json(stability *ecs.Stability) *stability_json {
+	record := &stability_json{
+		Record:      "stability",
+		Domain:      stability.Domain,
+		Ns_ip:       stability.Nameserver.String(),
+		Subnet:      subnet_str(stability.Subnet),
+		Queries:     stability.Queries,
+		Answered:    stability.Answered,
+		Answer_sets: make([]*answer_set_json, 0, len(stability.Answer_sets)),
+		Stability:   stability.Score,
+	}
+	if stability.Baseline {
+		record.Record = "baseline_stability"
+	}
+	for _, set := range stability.Answer_sets {
+		record.Answer_sets = append(record.Answer_sets, &answer_set_json{Answers: set.Answers, Count: set.Count})
+	}
+	return record
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"ecs/ecs"
+)
+
+// the csv and json summaries of New_stability
+func TestStabilityFormats(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	result := func(err error, answers ...string) *ecs.Result {
+		r := &ecs.Result{Domain: "example.com.", Nameserver: net.ParseIP("192.0.2.53"), Subnet: subnet, Err: err}
+		for _, answer := range answers {
+			r.Answers = append(r.Answers, net.ParseIP(answer))
+		}
+		return r
+	}
+	timeout := errors.New("timeout")
+	tests := []struct {
+		name    string
+		results []*ecs.Result
+		csv     []string
+		sets    []answer_set_json
+	}{
+		{"identical repeats", []*ecs.Result{result(nil, "198.51.100.2", "198.51.100.1"), result(nil, "198.51.100.1", "198.51.100.2")},
+			[]string{"example.com.", "192.0.2.53", "203.0.113.0/24", "2", "2", "1", "1.000", "198.51.100.1,198.51.100.2=2"},
+			[]answer_set_json{{Answers: []string{"198.51.100.1", "198.51.100.2"}, Count: 2}}},
+		{"changing answers", []*ecs.Result{result(nil, "198.51.100.1"), result(nil, "198.51.100.3"), result(nil, "198.51.100.3"), result(timeout)},
+			[]string{"example.com.", "192.0.2.53", "203.0.113.0/24", "4", "3", "2", "0.667", "198.51.100.3=2|198.51.100.1=1"},
+			[]answer_set_json{{Answers: []string{"198.51.100.3"}, Count: 2}, {Answers: []string{"198.51.100.1"}, Count: 1}}},
+		{"empty answer", []*ecs.Result{result(nil)},
+			[]string{"example.com.", "192.0.2.53", "203.0.113.0/24", "1", "1", "1", "1.000", "=1"},
+			[]answer_set_json{{Answers: []string{}, Count: 1}}},
+		{"all failing", []*ecs.Result{result(timeout), result(timeout)},
+			[]string{"example.com.", "192.0.2.53", "203.0.113.0/24", "2", "0", "0", "0.000", ""},
+			[]answer_set_json{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stability := ecs.New_stability(test.results)
+			if got := stability_csv_strarr(stability); !slices.Equal(got, test.csv) {
+				t.Errorf("csv\n got %q\nwant %q", got, test.csv)
+			}
+			record := stability_to_json(stability)
+			if record.Record != "stability" || record.Subnet != "203.0.113.0/24" || record.Queries != len(test.results) {
+				t.Errorf("json %+v", record)
+			}
+			if len(record.Answer_sets) != len(test.sets) {
+				t.Fatalf("%d answer sets, want %d", len(record.Answer_sets), len(test.sets))
+			}
+			for i, set := range record.Answer_sets {
+				if !slices.Equal(set.Answers, test.sets[i].Answers) || set.Count != test.sets[i].Count {
+					t.Errorf("answer set %d = %+v, want %+v", i, set, test.sets[i])
+				}
+			}
+		})
+	}
+
+	// the summary of the baseline without ecs
+	baseline := ecs.New_stability([]*ecs.Result{{Domain: "example.com.", Nameserver: net.ParseIP("192.0.2.53"), Baseline: true}})
+	if row := stability_csv_strarr(baseline); row[2] != "" {
+		t.Errorf("baseline subnet %q", row[2])
+	}
+	if record := stability_to_json(baseline); record.Record != "baseline_stability" || record.Subnet != "" {
+		t.Errorf("baseline json %+v", record)
+	}
+}